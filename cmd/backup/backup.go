@@ -5,18 +5,21 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"time"
 
+	"github.com/SingularGamesStudio/backup/cmd/crypt"
 	"github.com/SingularGamesStudio/backup/cmd/utils"
 	"github.com/SingularGamesStudio/backup/cmd/utils/file"
 )
 
 type Info struct {
-	Type string `json:"Type"`
-	Base string `json:"Base"`
+	Type        string `json:"Type"`
+	Base        string `json:"Base"`                  // full backup the chain starts with
+	Parent      string `json:"Parent,omitempty"`      // backup this one is based on
+	Compression string `json:"Compression,omitempty"` // codec new chunks were compressed with
+	Source      string `json:"Source,omitempty"`      // backup this one was consolidated from
 }
 
 // Setup creates path, and asks user to delete everything inside
@@ -56,18 +59,21 @@ func CheckJson(path string) (bool, error) {
 
 // GetJson reads metadata file from path
 func GetJson(path string) (Info, error) {
-	file, err := os.Open(filepath.Join(path, utils.Metadata))
+	data, err := readMeta(path, utils.Metadata)
 	if err != nil {
 		return Info{}, err
 	}
-	defer file.Close()
-	data, err := io.ReadAll(file)
+	res := Info{}
+	err = json.Unmarshal(data, &res)
 	if err != nil {
 		return Info{}, err
 	}
-	res := Info{}
-	err = json.Unmarshal(data, &res)
-	return res, err
+	for _, name := range []string{res.Base, res.Parent, res.Source} {
+		if name != "" && (!filepath.IsLocal(name) || filepath.Base(name) != name) { // backups are only looked up next to this one
+			return Info{}, fmt.Errorf("%w: %s refers to backup %q", utils.ErrCorrupted, filepath.Join(path, utils.Metadata), name)
+		}
+	}
+	return res, nil
 }
 
 // TryAbort tries to delete everything in dir
@@ -85,15 +91,39 @@ func TryAbort(dir string) {
 
 // SaveInfo saves backup metadata
 func SaveInfo(dir string, info Info) error {
-	file, err := os.Create(filepath.Join(dir, utils.Metadata))
+	data, err := json.Marshal(info)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	data, err := json.Marshal(info)
+	return writeMeta(dir, utils.Metadata, data)
+}
+
+// readMeta reads file name from backup dir, decrypting it if backup folder is encrypted
+func readMeta(dir string, name string) ([]byte, error) {
+	key, err := crypt.Unlock(filepath.Dir(dir))
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil || key == nil {
+		return data, err
+	}
+	return key.Open(data, metaName(dir, name))
+}
+
+// writeMeta saves data to file name in backup dir, encrypting it if backup folder is encrypted
+func writeMeta(dir string, name string, data []byte) error {
+	key, err := crypt.Unlock(filepath.Dir(dir))
 	if err != nil {
 		return err
 	}
-	_, err = file.Write(data)
-	return err
+	if key != nil {
+		data = key.Seal(data, metaName(dir, name))
+	}
+	return os.WriteFile(filepath.Join(dir, name), data, 0666)
+}
+
+// metaName returns name encrypted file name in dir is bound to, so that it can not be swapped with the same file of another backup
+func metaName(dir string, name string) string {
+	return filepath.Base(dir) + "/" + name
 }
@@ -0,0 +1,112 @@
+package backup
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Chain returns backups dir is built from, starting with the full one and ending with dir
+func Chain(dir string) ([]string, error) {
+	var chain []string
+	visited := make(map[string]bool)
+	for {
+		if visited[dir] {
+			return nil, fmt.Errorf("backup chain of %s is cyclic", chain[0])
+		}
+		visited[dir] = true
+		chain = append(chain, dir)
+		info, err := GetJson(dir)
+		if err != nil {
+			return nil, err
+		}
+		if info.Type == "full" {
+			break
+		}
+		parent := info.Parent
+		if parent == "" { // made before incremental chains
+			parent = info.Base
+		}
+		if parent == "" {
+			return nil, fmt.Errorf("%s backup %s has no parent", info.Type, dir)
+		}
+		dir = filepath.Join(filepath.Dir(dir), parent)
+	}
+	slices.Reverse(chain)
+	return chain, nil
+}
+
+// Resolve returns manifest listing everything saved in backup dir, applying manifests of its chain in order
+func Resolve(dir string) (Manifest, error) {
+	chain, err := Chain(dir)
+	if err != nil {
+		return Manifest{}, err
+	}
+	state := make(map[string]Entry)
+	for _, link := range chain {
+		manifest, err := GetManifest(link)
+		if err != nil {
+			return Manifest{}, err
+		}
+		Apply(state, manifest)
+	}
+	res := Manifest{Entries: make([]Entry, 0, len(state))}
+	for _, entry := range state {
+		res.Entries = append(res.Entries, entry)
+	}
+	sort.Slice(res.Entries, func(i, j int) bool { // parents go before children, like in os.ReadDir traversal
+		return strings.ReplaceAll(res.Entries[i].Path, "/", "\x00") < strings.ReplaceAll(res.Entries[j].Path, "/", "\x00")
+	})
+	return res, nil
+}
+
+// Apply applies changes from manifest to state (entries by path), the same way ApplyEntry does on disk
+func Apply(state map[string]Entry, manifest Manifest) {
+	removed := make(map[string]bool)
+	for _, entry := range manifest.Entries {
+		if entry.Change == Deleted || entry.Change == TypeChanged {
+			removed[entry.Path] = true
+		}
+	}
+	if len(removed) > 0 {
+		for path := range state {
+			if isRemoved(removed, path) {
+				delete(state, path)
+			}
+		}
+	}
+	for _, entry := range manifest.Entries {
+		if entry.Change == Deleted {
+			continue
+		}
+		if entry.Change == MetadataChanged { // contents are the same as in the previous version
+			prev := state[entry.Path]
+			prev.Mode, prev.Uid, prev.Gid, prev.ModTime, prev.Atime = entry.Mode, entry.Uid, entry.Gid, entry.ModTime, entry.Atime
+			if manifest.Xattrs {
+				prev.Xattrs = entry.Xattrs
+			}
+			state[entry.Path] = prev
+			continue
+		}
+		if patchesBase(entry) { // the previous version has to be kept
+			prev := state[entry.Path]
+			entry.Chunks = prev.Chunks
+			entry.Delta = append(slices.Clip(prev.Delta), entry.Delta...)
+		}
+		entry.Change, entry.From = "", ""
+		state[entry.Path] = entry
+	}
+}
+
+// isRemoved checks whether p or any of its parents is in removed
+func isRemoved(removed map[string]bool, p string) bool {
+	for ; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if removed[p] {
+			return true
+		}
+	}
+	return false
+}
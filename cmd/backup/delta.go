@@ -0,0 +1,159 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/SingularGamesStudio/backup/cmd/chunk"
+	"github.com/SingularGamesStudio/backup/cmd/delta"
+	"github.com/SingularGamesStudio/backup/cmd/utils"
+	"github.com/SingularGamesStudio/backup/cmd/utils/file"
+)
+
+// SaveDelta saves file dir/rel as a binary delta against its base backup entry old.
+// Returns false without saving anything if the delta is not at least twice smaller than the file,
+// or either version is sparse (holes would be read as zeroes)
+func SaveDelta(ctx context.Context, store *chunk.Store, index *Index, old Entry, dir string, rel string) (Entry, bool, error) {
+	path := filepath.Join(dir, rel)
+	info, err := Lstat(path)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	if sparse, err := isSparse(path, info.Size()); err != nil || sparse || old.Extents != nil {
+		return Entry{}, false, err
+	}
+	entry, err := NewEntry(dir, rel)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	tmpDir, err := os.MkdirTemp("", "backup-delta")
+	if err != nil {
+		return Entry{}, false, err
+	}
+	defer os.RemoveAll(tmpDir)
+	base := store.Reader(ctx, old.Chunks)
+	if len(old.Delta) > 0 { // only a file can be patched
+		basePath := filepath.Join(tmpDir, "base")
+		err = restoreFile(ctx, store, old, basePath)
+		if err != nil {
+			return Entry{}, false, err
+		}
+		f, err := os.Open(basePath)
+		if err != nil {
+			return Entry{}, false, err
+		}
+		defer f.Close()
+		base = f
+	}
+	deltaPath := filepath.Join(tmpDir, "delta")
+	hash, size, err := diffFile(base, old.Size, path, deltaPath)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	if size*2 > entry.Size {
+		return Entry{}, false, nil
+	}
+	ids, _, _, err := store.SaveFile(ctx, deltaPath)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	entry.Hash = hash
+	entry.Delta = [][]string{ids}
+	index.Update(rel, info, Entry{Hash: hash, Chunks: old.Chunks, Delta: append(slices.Clip(old.Delta), ids)})
+	return entry, true, nil
+}
+
+// isSparse checks whether file at path has holes
+func isSparse(path string, size int64) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	extents, err := file.Extents(f, size)
+	return extents != nil, err
+}
+
+// diffFile writes delta turning base (of baseSize bytes) into target to deltaPath, and returns SHA-256 of target and delta size
+func diffFile(base io.Reader, baseSize int64, targetPath string, deltaPath string) (string, int64, error) {
+	target, err := os.Open(targetPath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer target.Close()
+	out, err := os.Create(deltaPath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer out.Close()
+	hash := sha256.New()
+	size, err := delta.Diff(base, baseSize, io.TeeReader(target, hash), out)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, out.Close()
+}
+
+// restoreFile writes contents of file entry to path, applying its deltas (to the file already at path, if entry has no chunks)
+// and checking the result against its hash
+func restoreFile(ctx context.Context, store *chunk.Store, entry Entry, path string) error {
+	if !patchesBase(entry) {
+		err := store.WriteFile(ctx, entry.Chunks, entry.Extents, entry.Size, path)
+		if err != nil {
+			return err
+		}
+	}
+	if len(entry.Delta) == 0 {
+		return nil
+	}
+	for _, ids := range entry.Delta {
+		err := patchFile(ctx, store, ids, path)
+		if err != nil {
+			return fmt.Errorf("applying delta to %s: %w", entry.Path, err)
+		}
+	}
+	hash, err := file.Hash(ctx, path)
+	if err != nil {
+		return err
+	}
+	if hash != entry.Hash {
+		return fmt.Errorf("%w: %s does not match its hash after applying delta", utils.ErrCorrupted, entry.Path)
+	}
+	return nil
+}
+
+// patchesBase checks whether entry is a delta against the file restored from the base backup, rather than self-contained
+func patchesBase(entry Entry) bool {
+	return len(entry.Delta) > 0 && len(entry.Chunks) == 0
+}
+
+// patchFile replaces file at path with the result of applying delta stored in chunks with given ids to it
+func patchFile(ctx context.Context, store *chunk.Store, ids []string, path string) error {
+	base, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	err = delta.Patch(base, store.Reader(ctx, ids), tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	base.Close() // file can not be replaced while open on windows
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
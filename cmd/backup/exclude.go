@@ -0,0 +1,36 @@
+package backup
+
+import (
+	"github.com/SingularGamesStudio/backup/cmd/ignore"
+)
+
+// IgnoreFile is the name of files with gitignore-style patterns of paths not to save, in the directory they are in
+const IgnoreFile = ".backupignore"
+
+// GitIgnore makes backup also skip paths ignored by .gitignore files (IgnoreFile ones override them)
+var GitIgnore = false
+
+// ExcludeCaches makes backup skip directories tagged as caches with CACHEDIR.TAG file
+var ExcludeCaches = false
+
+// Exclude are gitignore-style patterns of paths not to save (or to save anyway, if they start with !), relative to the backed up folder.
+// They take precedence over ignore files
+var Exclude []string
+
+// Excluded checks whether dir/rel should not be saved because of Exclude patterns, ignore files or cache tag.
+// Its parent directories must be checked first
+func (m *Manifest) Excluded(dir string, rel string, isDir bool) (bool, error) {
+	if m.rules == nil {
+		names := []string{IgnoreFile}
+		if GitIgnore {
+			names = []string{".gitignore", IgnoreFile}
+		}
+		rules, err := ignore.New(dir, Exclude, names...)
+		if err != nil {
+			return false, err
+		}
+		rules.Caches = ExcludeCaches
+		m.rules = rules
+	}
+	return m.rules.Match(rel, isDir)
+}
@@ -0,0 +1,49 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/SingularGamesStudio/backup/cmd/utils/file"
+)
+
+// inode identifies a file with several hard links
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// Linked returns entry for dir/rel (described by info) as a hard link to a file with the same device and inode,
+// which was remembered earlier while building manifest
+func (m *Manifest) Linked(dir string, rel string, info os.FileInfo) (Entry, bool, error) {
+	dev, ino, nlink := file.HardLinks(info)
+	if !info.Mode().IsRegular() || nlink < 2 {
+		return Entry{}, false, nil
+	}
+	target, ok := m.links[inode{dev, ino}]
+	if !ok || target.Path == filepath.ToSlash(rel) {
+		return Entry{}, false, nil
+	}
+	entry, err := NewEntry(dir, rel)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	// contents are kept too, so that the file can be restored even if the link target is gone
+	entry.CopyContents(target)
+	entry.LinkTo = target.Path
+	return entry, true, nil
+}
+
+// Remember remembers file entry (described by info), if it has other hard links, so that they are saved as links to it
+func (m *Manifest) Remember(entry Entry, info os.FileInfo) {
+	dev, ino, nlink := file.HardLinks(info)
+	if !info.Mode().IsRegular() || nlink < 2 {
+		return
+	}
+	if m.links == nil {
+		m.links = make(map[inode]Entry)
+	}
+	if _, ok := m.links[inode{dev, ino}]; !ok {
+		m.links[inode{dev, ino}] = entry
+	}
+}
@@ -0,0 +1,155 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/SingularGamesStudio/backup/cmd/utils"
+	"github.com/SingularGamesStudio/backup/cmd/utils/file"
+)
+
+// Record describes file state at the moment its contents were last read
+type Record struct {
+	Inode   uint64        `json:"Inode"`
+	Size    int64         `json:"Size"`
+	ModTime time.Time     `json:"ModTime"`
+	Ctime   time.Time     `json:"Ctime"`
+	Hash    string        `json:"Hash"`
+	Chunks  []string      `json:"Chunks"`
+	Delta   [][]string    `json:"Delta,omitempty"`
+	Extents []file.Extent `json:"Extents,omitempty"`
+}
+
+// Index remembers hashes and chunks of files in a backed up folder (like git index),
+// so that files with the same inode, size, mtime and ctime are not read again.
+// Methods of nil index do nothing
+type Index struct {
+	root   string
+	name   string
+	old    map[string]Record
+	new    map[string]Record
+	inodes map[uint64]string // paths of old records by inode, built on first Find
+}
+
+// LoadIndex loads index of source folder from backup folder root, index is empty if it was never saved
+func LoadIndex(root string, source string) (*Index, error) {
+	abs, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	index := &Index{
+		root: root,
+		name: hex.EncodeToString(sum[:16]),
+		old:  make(map[string]Record),
+		new:  make(map[string]Record),
+	}
+	data, err := readMeta(filepath.Join(root, utils.Index), index.name)
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &index.old)
+	return index, err
+}
+
+// Lookup returns saved record of file dir/rel, if the file did not change since
+func (idx *Index) Lookup(rel string, info os.FileInfo) (Record, bool) {
+	if idx == nil {
+		return Record{}, false
+	}
+	record, ok := idx.old[filepath.ToSlash(rel)]
+	if !ok || !record.matches(info) {
+		return Record{}, false
+	}
+	return record, true
+}
+
+// Find returns (slash-separated) path and saved record of a file with the same inode, size and mtime as info,
+// which is how a file looks after being renamed
+func (idx *Index) Find(info os.FileInfo) (string, Record, bool) {
+	if idx == nil {
+		return "", Record{}, false
+	}
+	inode, _ := file.Inode(info)
+	if inode == 0 {
+		return "", Record{}, false
+	}
+	if idx.inodes == nil {
+		idx.inodes = make(map[uint64]string, len(idx.old))
+		for path, record := range idx.old {
+			idx.inodes[record.Inode] = path
+		}
+	}
+	path, ok := idx.inodes[inode]
+	if !ok {
+		return "", Record{}, false
+	}
+	record := idx.old[path]
+	if record.Size != info.Size() || !record.ModTime.Equal(info.ModTime()) {
+		return "", Record{}, false
+	}
+	return path, record, true
+}
+
+// Update records hash and contents of file dir/rel from its entry (which must not depend on the base backup), to be saved in the new index
+func (idx *Index) Update(rel string, info os.FileInfo, entry Entry) {
+	if idx == nil {
+		return
+	}
+	// file might still be changing within timestamp precision, so its stat can not be trusted yet
+	if time.Since(info.ModTime()) < 2*time.Second {
+		return
+	}
+	idx.new[filepath.ToSlash(rel)] = newRecord(info, entry)
+}
+
+// Keep moves record of unchanged file dir/rel to the new index
+func (idx *Index) Keep(rel string, info os.FileInfo) {
+	if record, ok := idx.Lookup(rel, info); ok {
+		idx.new[filepath.ToSlash(rel)] = record
+	}
+}
+
+// Save replaces saved index with records updated or kept since it was loaded
+func (idx *Index) Save() error {
+	if idx == nil {
+		return nil
+	}
+	data, err := json.Marshal(idx.new)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(idx.root, utils.Index), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return writeMeta(filepath.Join(idx.root, utils.Index), idx.name, data)
+}
+
+func newRecord(info os.FileInfo, entry Entry) Record {
+	inode, ctime := file.Inode(info)
+	return Record{
+		Inode:   inode,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Ctime:   ctime,
+		Hash:    entry.Hash,
+		Chunks:  entry.Chunks,
+		Delta:   entry.Delta,
+		Extents: entry.Extents,
+	}
+}
+
+// matches checks whether file described by info has the same inode, size, mtime and ctime as when record was made
+func (r Record) matches(info os.FileInfo) bool {
+	inode, ctime := file.Inode(info)
+	return r.Inode == inode && r.Size == info.Size() && r.ModTime.Equal(info.ModTime()) && r.Ctime.Equal(ctime)
+}
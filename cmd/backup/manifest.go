@@ -0,0 +1,367 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/SingularGamesStudio/backup/cmd/chunk"
+	"github.com/SingularGamesStudio/backup/cmd/ignore"
+	"github.com/SingularGamesStudio/backup/cmd/utils"
+	"github.com/SingularGamesStudio/backup/cmd/utils/file"
+)
+
+// Changes recorded in incremental backup manifests
+const (
+	Added       = "added"
+	Modified    = "modified"
+	Deleted     = "deleted"
+	TypeChanged = "type-changed" // e.g. file replaced with a directory
+	Moved       = "moved"        // file with the same contents as a file deleted since the base backup
+
+	MetadataChanged = "metadata-changed" // only mode, owner or mtime changed, contents are not saved
+)
+
+// Times makes restore set mtime and atime of restored entries
+var Times = true
+
+// Xattrs makes backup save extended attributes and POSIX ACLs of entries (they are always restored, if saved)
+var Xattrs = false
+
+// special are mode bits of files, which have no contents to save and are recreated with mknod
+const special = os.ModeNamedPipe | os.ModeSocket | os.ModeDevice
+
+// xattrsWarning is printed once, when restoring to a filesystem without extended attributes
+var xattrsWarning sync.Once
+
+// Entry describes a single file, directory, symlink or special file (FIFO, socket or device, only its metadata) saved in a backup
+type Entry struct {
+	Path    string            `json:"Path"` // slash-separated, relative to the backed up folder
+	Mode    os.FileMode       `json:"Mode"`
+	Uid     int               `json:"Uid"`
+	Gid     int               `json:"Gid"`
+	ModTime time.Time         `json:"ModTime"`
+	Atime   time.Time         `json:"Atime"` // when the file was last read before the backup
+	Size    int64             `json:"Size"`
+	Link    string            `json:"Link,omitempty"`    // symlink target
+	Major   uint32            `json:"Major,omitempty"`   // major and minor device numbers, for block and character devices
+	Minor   uint32            `json:"Minor,omitempty"`   // see Major
+	Xattrs  map[string][]byte `json:"Xattrs,omitempty"`  // extended attributes, including POSIX ACLs
+	Chunks  []string          `json:"Chunks,omitempty"`  // ids of file contents in chunk store
+	Hash    string            `json:"Hash,omitempty"`    // SHA-256 of file contents
+	Extents []file.Extent     `json:"Extents,omitempty"` // data regions of sparse file, Chunks only contain them
+	Delta   [][]string        `json:"Delta,omitempty"`   // ids of binary deltas to apply in order on top of Chunks (or of the file restored from the base backup, if there are no Chunks)
+	Change  string            `json:"Change,omitempty"`  // how entry changed since the base backup, empty in full backups
+	From    string            `json:"From,omitempty"`    // path the file was moved from, for moved entries
+	LinkTo  string            `json:"LinkTo,omitempty"`  // earlier saved path, this file is a hard link to
+}
+
+// Manifest lists everything saved in a backup (or changed, for incremental ones), parents always go before their children
+type Manifest struct {
+	Entries []Entry `json:"Entries"`
+	Xattrs  bool    `json:"Xattrs,omitempty"` // extended attributes of entries were saved, otherwise they are kept from previous versions
+
+	links  map[inode]Entry // files with several hard links, by device and inode
+	mounts []string        // directories, which were not entered because other filesystems are mounted on them
+	rules  *ignore.Rules   // which paths are excluded, created on first use
+}
+
+// NewEntry creates entry for dir/rel, without saving its contents
+func NewEntry(dir string, rel string) (Entry, error) {
+	path := filepath.Join(dir, rel)
+	info, err := Lstat(path)
+	if err != nil {
+		return Entry{}, err
+	}
+	uid, gid := file.Owner(info)
+	entry := Entry{
+		Path:    filepath.ToSlash(rel),
+		Mode:    info.Mode(),
+		Uid:     uid,
+		Gid:     gid,
+		ModTime: info.ModTime(),
+		Atime:   file.AccessTime(info),
+		Size:    info.Size(),
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		entry.Link, err = os.Readlink(path)
+		if err != nil {
+			return Entry{}, err
+		}
+	}
+	if info.Mode()&os.ModeDevice != 0 {
+		entry.Major, entry.Minor = file.Device(info)
+	}
+	if Xattrs {
+		entry.Xattrs, err = file.Xattrs(path)
+		if errors.Is(err, errors.ErrUnsupported) {
+			err = nil
+		}
+		if err != nil {
+			return Entry{}, fmt.Errorf("reading extended attributes of %s: %w", entry.Path, err)
+		}
+	}
+	return entry, nil
+}
+
+// SaveEntry creates entry for dir/rel, saving file contents to store, unless index shows they are already there
+func SaveEntry(ctx context.Context, store *chunk.Store, index *Index, dir string, rel string) (Entry, error) {
+	entry, err := NewEntry(dir, rel)
+	if err != nil {
+		return Entry{}, err
+	}
+	if !entry.Mode.IsRegular() {
+		return entry, nil
+	}
+	info, err := Lstat(filepath.Join(dir, rel))
+	if err != nil {
+		return Entry{}, err
+	}
+	if record, ok := index.Lookup(rel, info); ok && hasChunks(store, record.Chunks, record.Delta) {
+		entry.Chunks, entry.Extents, entry.Hash, entry.Delta = record.Chunks, record.Extents, record.Hash, record.Delta
+	} else {
+		entry.Chunks, entry.Extents, entry.Hash, err = store.SaveFile(ctx, filepath.Join(dir, rel))
+		if err != nil {
+			return Entry{}, err
+		}
+	}
+	index.Update(rel, info, entry)
+	return entry, nil
+}
+
+// CopyContents makes file entry have the same contents as from, which is already saved
+func (e *Entry) CopyContents(from Entry) {
+	e.Chunks, e.Extents, e.Hash, e.Delta = from.Chunks, from.Extents, from.Hash, from.Delta
+}
+
+// hasChunks checks whether all chunks of contents and deltas are present in store (e.g. were not pruned since the index was saved)
+func hasChunks(store *chunk.Store, ids []string, delta [][]string) bool {
+	for _, ids := range append([][]string{ids}, delta...) {
+		for _, id := range ids {
+			if ok, err := store.Has(id); err != nil || !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Snapshot saves contents of dir/rel recursively to store (updating index), and appends their entries to manifest
+func Snapshot(ctx context.Context, store *chunk.Store, index *Index, dir string, rel string, manifest *Manifest) error {
+	entries, err := os.ReadDir(filepath.Join(dir, rel))
+	if err != nil {
+		return err
+	}
+	for _, dirEntry := range entries {
+		info, ok, err := WalkInfo(dir, filepath.Join(rel, dirEntry.Name()), dirEntry)
+		excluded := false
+		if err == nil && ok {
+			excluded, err = manifest.Excluded(dir, filepath.Join(rel, dirEntry.Name()), info.IsDir())
+		}
+		if err != nil {
+			return err
+		}
+		if !ok || excluded {
+			continue
+		}
+		entry, linked, err := manifest.Linked(dir, filepath.Join(rel, dirEntry.Name()), info)
+		if err == nil && !linked {
+			entry, err = SaveEntry(ctx, store, index, dir, filepath.Join(rel, dirEntry.Name()))
+			manifest.Remember(entry, info)
+		}
+		if err != nil {
+			return err
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+		if info.IsDir() {
+			descend, err := manifest.Descend(dir, filepath.Join(rel, dirEntry.Name()), info)
+			if err == nil && descend {
+				err = Snapshot(ctx, store, index, dir, filepath.Join(rel, dirEntry.Name()), manifest)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+	}
+	return nil
+}
+
+// RestoreEntry recreates entry inside dir, taking file contents from store
+func RestoreEntry(ctx context.Context, store *chunk.Store, entry Entry, dir string) error {
+	if throughLink(dir, entry.Path) {
+		return fmt.Errorf("%w: %s is inside a symlink", utils.ErrCorrupted, entry.Path)
+	}
+	return restoreEntry(ctx, store, entry, dir)
+}
+
+// restoreEntry is RestoreEntry for entry, which is known not to be inside a symlink
+func restoreEntry(ctx context.Context, store *chunk.Store, entry Entry, dir string) error {
+	path := filepath.Join(dir, filepath.FromSlash(entry.Path))
+	err := clearPath(path, entry)
+	if err != nil {
+		return err
+	}
+	switch {
+	case entry.Mode.IsDir():
+		err = os.MkdirAll(path, entry.Mode.Perm())
+	case refused(entry):
+		fmt.Printf("Skipping %s: link to %s points outside of the restored folder\n", entry.Path, entry.Link)
+		return nil
+	case entry.Mode&os.ModeSymlink != 0:
+		err = os.Symlink(entry.Link, path)
+	case entry.Mode&special != 0:
+		err = file.Mknod(path, entry.Mode, entry.Major, entry.Minor)
+		if errors.Is(err, os.ErrPermission) || errors.Is(err, errors.ErrUnsupported) { // devices can only be created by root
+			fmt.Printf("Skipping %s: %s\n", entry.Path, err.Error())
+			return nil
+		}
+	case entry.LinkTo != "" && !throughLink(dir, entry.LinkTo) && os.Link(filepath.Join(dir, filepath.FromSlash(entry.LinkTo)), path) == nil:
+		// otherwise link target is gone (or is not where it was saved), or filesystem does not support hard links, so contents are restored
+	default:
+		err = restoreFile(ctx, store, entry, path)
+	}
+	if err != nil {
+		return err
+	}
+	return setMetadata(path, entry)
+}
+
+// setMetadata sets owner, mode, extended attributes and times (unless it is a directory, which has to wait until its children are restored)
+// of restored entry at path
+func setMetadata(path string, entry Entry) error {
+	if len(entry.Xattrs) > 0 { // before mode, as attributes can not be set on read-only files without privileges
+		err := file.SetXattrs(path, entry.Xattrs)
+		if errors.Is(err, os.ErrPermission) && entry.Mode&os.ModeSymlink == 0 && os.Chmod(path, entry.Mode.Perm()|0200) == nil {
+			err = file.SetXattrs(path, entry.Xattrs) // file restored earlier is read-only, its mode is set back below
+		}
+		if errors.Is(err, errors.ErrUnsupported) {
+			xattrsWarning.Do(func() {
+				fmt.Println("Warning: target filesystem does not support extended attributes, they are not restored")
+			})
+		} else if err != nil { // e.g. security labels can not be set without privileges
+			fmt.Printf("Warning: extended attributes of %s are not restored: %s\n", entry.Path, err.Error())
+		}
+	}
+	err := file.SetRights(path, entry.Mode, entry.Uid, entry.Gid)
+	if err != nil {
+		return err
+	}
+	if !Times || entry.Mode.IsDir() {
+		return nil
+	}
+	return file.SetTimes(path, entry.Mode, entry.atime(), entry.ModTime)
+}
+
+// atime returns entry access time, which is not saved by old backups
+func (e Entry) atime() time.Time {
+	if e.Atime.IsZero() {
+		return e.ModTime
+	}
+	return e.Atime
+}
+
+// RestoreDirTimes sets times of directories from manifest inside dir, children first, once everything inside them is restored
+func RestoreDirTimes(ctx context.Context, manifest Manifest, dir string) error {
+	if !Times {
+		return nil
+	}
+	for i := len(manifest.Entries) - 1; i >= 0; i-- {
+		entry := manifest.Entries[i]
+		if !entry.Mode.IsDir() {
+			continue
+		}
+		err := file.SetTimes(filepath.Join(dir, filepath.FromSlash(entry.Path)), entry.Mode, entry.atime(), entry.ModTime)
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+	}
+	return nil
+}
+
+// clearPath removes whatever is at path before entry is restored there (so that nothing is written through a symlink,
+// and types always match), except for a directory to be restored as a directory and the base of a delta
+func clearPath(path string, entry Entry) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() == entry.Mode.Type() && (entry.Mode.IsDir() || patchesBase(entry)) {
+		return nil
+	}
+	return os.RemoveAll(path)
+}
+
+// ApplyEntry applies change described by incremental backup entry to dir
+func ApplyEntry(ctx context.Context, store *chunk.Store, entry Entry, dir string) error {
+	if throughLink(dir, entry.Path) { // nothing outside of dir must be changed or deleted
+		return fmt.Errorf("%w: %s is inside a symlink", utils.ErrCorrupted, entry.Path)
+	}
+	switch entry.Change {
+	case Deleted:
+		return os.RemoveAll(filepath.Join(dir, filepath.FromSlash(entry.Path)))
+	case TypeChanged:
+		err := os.RemoveAll(filepath.Join(dir, filepath.FromSlash(entry.Path)))
+		if err != nil {
+			return err
+		}
+	case MetadataChanged:
+		path := filepath.Join(dir, filepath.FromSlash(entry.Path))
+		if refused(entry) { // link was not restored
+			return nil
+		}
+		if _, err := os.Lstat(path); entry.Mode&special != 0 && errors.Is(err, os.ErrNotExist) { // special file could not be created
+			return nil
+		}
+		return setMetadata(path, entry)
+	}
+	return restoreEntry(ctx, store, entry, dir)
+}
+
+// SaveManifest saves backup manifest to dir
+func SaveManifest(dir string, manifest Manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return writeMeta(dir, utils.Manifest, data)
+}
+
+// GetManifest reads backup manifest from dir
+func GetManifest(dir string) (Manifest, error) {
+	data, err := readMeta(dir, utils.Manifest)
+	if err != nil {
+		return Manifest{}, err
+	}
+	res := Manifest{}
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return Manifest{}, err
+	}
+	local := func(path string) bool {
+		return filepath.IsLocal(filepath.FromSlash(path))
+	}
+	for _, entry := range res.Entries { // otherwise restore could write or delete files outside of the restored folder
+		if !local(entry.Path) || (entry.LinkTo != "" && !local(entry.LinkTo)) || (entry.From != "" && !local(entry.From)) {
+			return Manifest{}, fmt.Errorf("%w: %s has entry %q referring to a path outside of the backed up folder", utils.ErrCorrupted, filepath.Join(dir, utils.Manifest), entry.Path)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,43 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/SingularGamesStudio/backup/cmd/utils/file"
+)
+
+// OneFileSystem makes backup stay on the filesystem of the backed up folder: directories other filesystems are mounted on
+// are saved, but not their contents
+var OneFileSystem = false
+
+// Descend checks whether walk should go into directory dir/rel, described by info.
+// With OneFileSystem mount points are not entered, and are remembered to be reported by PrintMountPoints
+func (m *Manifest) Descend(dir string, rel string, info os.FileInfo) (bool, error) {
+	if !OneFileSystem {
+		return true, nil
+	}
+	root, err := os.Stat(dir)
+	if err != nil {
+		return false, err
+	}
+	rootDev, _, _ := file.HardLinks(root)
+	dev, _, _ := file.HardLinks(info)
+	if dev == rootDev {
+		return true, nil
+	}
+	m.mounts = append(m.mounts, filepath.ToSlash(rel))
+	return false, nil
+}
+
+// PrintMountPoints lists mount points, whose contents were not saved because of OneFileSystem
+func (m *Manifest) PrintMountPoints() {
+	if len(m.mounts) == 0 {
+		return
+	}
+	fmt.Println("Skipped mount points (other filesystems are not saved):")
+	for _, mount := range m.mounts {
+		fmt.Println("  " + mount)
+	}
+}
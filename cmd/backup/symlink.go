@@ -0,0 +1,124 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Policies for symbolic links found by backup
+const (
+	Preserve = "preserve" // links are saved as links
+	Follow   = "follow"   // files and directories links point to are saved in their place (broken links are still saved as links)
+	Skip     = "skip"     // links are not saved
+)
+
+// Symlinks is the policy for symbolic links found by backup
+var Symlinks = Preserve
+
+// UnsafeLinks makes restore create symlinks pointing outside of the restored folder, which are skipped otherwise
+var UnsafeLinks = false
+
+// ValidSymlinks checks whether policy is one of the supported symlink policies
+func ValidSymlinks(policy string) error {
+	switch policy {
+	case Preserve, Follow, Skip:
+		return nil
+	}
+	return fmt.Errorf("unknown symlink policy %q, supported ones are %s, %s and %s", policy, Preserve, Follow, Skip)
+}
+
+// Lstat is os.Lstat, which follows symlinks if Symlinks policy is Follow
+func Lstat(path string) (os.FileInfo, error) {
+	if Symlinks == Follow {
+		if info, err := os.Stat(path); err == nil {
+			return info, nil
+		}
+	}
+	return os.Lstat(path)
+}
+
+// WalkInfo returns info of dir/rel, found as dirEntry while walking dir, according to Symlinks policy.
+// Returns false for entries, that are not saved: skipped links, and followed links to a directory containing them
+func WalkInfo(dir string, rel string, dirEntry os.DirEntry) (os.FileInfo, bool, error) {
+	if dirEntry.Type()&os.ModeSymlink == 0 || Symlinks == Preserve {
+		info, err := dirEntry.Info()
+		return info, true, err
+	}
+	if Symlinks == Skip {
+		return nil, false, nil
+	}
+	info, err := Lstat(filepath.Join(dir, rel))
+	if err != nil || !info.IsDir() {
+		return info, true, err
+	}
+	loop, err := loops(dir, rel, info)
+	if err != nil {
+		return nil, false, err
+	}
+	if loop {
+		fmt.Printf("Skipping %s: link to a directory containing it\n", filepath.ToSlash(rel))
+		return nil, false, nil
+	}
+	return info, true, nil
+}
+
+// loops checks whether directory info, which symlink dir/rel points to, is one of the directories the link was found in,
+// so following it would never end
+func loops(dir string, rel string, info os.FileInfo) (bool, error) {
+	for parent := filepath.Dir(rel); ; parent = filepath.Dir(parent) {
+		stat, err := os.Stat(filepath.Join(dir, parent))
+		if err != nil {
+			return false, err
+		}
+		if os.SameFile(stat, info) {
+			return true, nil
+		}
+		if parent == "." {
+			return false, nil
+		}
+	}
+}
+
+// escapes checks whether symlink entry might point outside of the folder it is restored to: is absolute, has more leading ..
+// than its depth, or has .. after a name (which might be another symlink, so .. would not go back where the name led)
+func escapes(entry Entry) bool {
+	if filepath.IsAbs(entry.Link) || filepath.VolumeName(entry.Link) != "" || path.IsAbs(filepath.ToSlash(entry.Link)) {
+		return true
+	}
+	depth := strings.Count(path.Clean(entry.Path), "/") // parents of entry are never symlinks, see throughLink
+	named := false
+	for _, part := range strings.Split(filepath.ToSlash(entry.Link), "/") {
+		switch {
+		case part == "" || part == ".":
+		case part == "..":
+			depth--
+			if named || depth < 0 {
+				return true
+			}
+		default:
+			named = true
+		}
+	}
+	return false
+}
+
+// throughLink checks whether any of parent directories of slash-separated rel inside dir is a symlink
+// (or can not be checked), so writing to rel would write wherever the link points
+func throughLink(dir string, rel string) bool {
+	for parent := path.Dir(rel); parent != "."; parent = path.Dir(parent) {
+		info, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(parent)))
+		if err != nil && !errors.Is(err, os.ErrNotExist) || err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// refused checks whether entry is a symlink, which restore must not create, because it points outside of the restored folder
+func refused(entry Entry) bool {
+	return entry.Mode&os.ModeSymlink != 0 && !UnsafeLinks && escapes(entry)
+}
@@ -0,0 +1,99 @@
+package chunk
+
+import (
+	"errors"
+	"io"
+)
+
+// Chunk size bounds, actual chunk boundaries depend on file contents (FastCDC)
+const (
+	MinSize = 256 << 10
+	AvgSize = 1 << 20
+	MaxSize = 4 << 20
+)
+
+// masks use top bits of the rolling hash, so that each cut depends on the last 64 bytes;
+// the harder one is used before the average size, the easier one after it (normalized chunking)
+const (
+	maskS = uint64(1<<22-1) << (64 - 22)
+	maskL = uint64(1<<18-1) << (64 - 18)
+)
+
+// gear maps bytes to random values for the rolling hash, it must never change,
+// otherwise new backups would not share chunks with old ones
+var gear [256]uint64
+
+func init() {
+	seed := uint64(0x6a09e667f3bcc908)
+	for i := range gear { // splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker splits a stream into content-defined chunks, so an edit only changes chunks around it
+type Chunker struct {
+	r   io.Reader
+	buf []byte
+	n   int
+	eof bool
+}
+
+// NewChunker creates chunker reading from r
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{r: r, buf: make([]byte, MaxSize)}
+}
+
+// Next returns the next chunk, or io.EOF if the stream is over
+func (c *Chunker) Next() ([]byte, error) {
+	if !c.eof && c.n < len(c.buf) {
+		m, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += m
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+	cut := cutPoint(c.buf[:c.n])
+	res := make([]byte, cut)
+	copy(res, c.buf[:cut])
+	c.n = copy(c.buf, c.buf[cut:c.n])
+	return res, nil
+}
+
+// cutPoint returns length of the first chunk in data
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= MinSize {
+		return n
+	}
+	if n > MaxSize {
+		n = MaxSize
+	}
+	normal := AvgSize
+	if n < normal {
+		normal = n
+	}
+	h := uint64(0)
+	i := MinSize
+	for ; i < normal; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
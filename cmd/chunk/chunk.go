@@ -0,0 +1,247 @@
+package chunk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/SingularGamesStudio/backup/cmd/crypt"
+	"github.com/SingularGamesStudio/backup/cmd/utils"
+	"github.com/SingularGamesStudio/backup/cmd/utils/file"
+)
+
+// Store is a content-addressed storage of file chunks, shared by all backups in a backup folder
+type Store struct {
+	dir string
+	key *crypt.Key // nil if backup folder is not encrypted
+}
+
+// Open opens chunk storage of the backup folder root, creating it if needed
+func Open(root string) (*Store, error) {
+	key, err := crypt.Unlock(root)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(root, utils.Chunks)
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, key: key}, nil
+}
+
+// id returns id of chunk with given contents
+func (s *Store) id(data []byte) string {
+	if s.key != nil {
+		return s.key.ID(data)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// path returns location of chunk with given id
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id[:2], id)
+}
+
+// find returns extension of the file chunk with given id is stored in, or os.ErrNotExist
+func (s *Store) find(id string) (string, error) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != sha256.Size*2 { // ids come from manifests, which might be tampered with
+		return "", fmt.Errorf("%w: invalid chunk id %q", utils.ErrCorrupted, id)
+	}
+	for _, ext := range []string{"", codecs["gzip"], codecs["zstd"]} {
+		_, err := os.Stat(s.path(id) + ext)
+		if err == nil {
+			return ext, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// Has checks whether chunk with given id is in the store
+func (s *Store) Has(id string) (bool, error) {
+	_, err := s.find(id)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Put saves data to the store compressed with codec (and encrypted, if backup folder is), unless the same data is already there, and returns its id
+func (s *Store) Put(data []byte, codec string) (string, error) {
+	id := s.id(data)
+	if _, err := s.find(id); err == nil {
+		return id, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	path := s.path(id)
+	compressed, err := compress(codec, data)
+	if err != nil {
+		return "", err
+	}
+	if compressed != nil {
+		data = compressed
+		path += codecs[codec]
+	}
+	if s.key != nil {
+		data = s.key.Seal(data, id)
+	}
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	// write to a temporary file first, so interrupted backup never leaves a partial chunk under a valid id
+	tmp, err := os.CreateTemp(filepath.Dir(path), id+".tmp*")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return id, nil
+}
+
+// Get reads chunk with given id, decrypting and decompressing it and checking its integrity
+func (s *Store) Get(id string) ([]byte, error) {
+	ext, err := s.find(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(s.path(id) + ext)
+	if err != nil {
+		return nil, err
+	}
+	if s.key != nil {
+		data, err = s.key.Open(data, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err = decompress(ext, data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", utils.ErrCorrupted, id, err)
+	}
+	if s.id(data) != id {
+		return nil, fmt.Errorf("%w: %s", utils.ErrCorrupted, id)
+	}
+	return data, nil
+}
+
+// SaveFile splits file into chunks, puts them into the store and returns their ids, data extents
+// (nil if file is not sparse, otherwise only they are saved) and SHA-256 of the whole file
+func (s *Store) SaveFile(ctx context.Context, path string) ([]string, []file.Extent, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	extents, err := file.Extents(f, stat.Size())
+	if err != nil {
+		return nil, nil, "", err
+	}
+	hash := sha256.New()
+	var data io.Reader = io.TeeReader(f, hash)
+	if extents != nil {
+		data = file.DataReader(f, extents, stat.Size(), hash)
+	}
+	var ids []string
+	codec := codecFor(path)
+	chunker := NewChunker(data)
+	for {
+		data, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			return ids, extents, hex.EncodeToString(hash.Sum(nil)), nil
+		}
+		if err != nil {
+			return nil, nil, "", err
+		}
+		id, err := s.Put(data, codec)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		ids = append(ids, id)
+		select {
+		case <-ctx.Done():
+			return nil, nil, "", ctx.Err()
+		default:
+		}
+	}
+}
+
+// WriteFile creates file at path, consisting of chunks with given ids. If extents are given, chunks only contain them,
+// and the rest of the file up to size is left as holes
+func (s *Store) WriteFile(ctx context.Context, ids []string, extents []file.Extent, size int64, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if extents == nil {
+		_, err = io.Copy(f, s.Reader(ctx, ids))
+		return err
+	}
+	data := s.Reader(ctx, ids)
+	for _, extent := range extents {
+		_, err = f.Seek(extent.Offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(f, data, extent.Length)
+		if err != nil {
+			return err
+		}
+	}
+	return f.Truncate(size)
+}
+
+// Reader returns reader of contents consisting of chunks with given ids, which are read one by one
+func (s *Store) Reader(ctx context.Context, ids []string) io.Reader {
+	return &reader{ctx: ctx, store: s, ids: ids}
+}
+
+type reader struct {
+	ctx   context.Context
+	store *Store
+	ids   []string
+	data  []byte
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if len(r.ids) == 0 {
+			return 0, io.EOF
+		}
+		if err := r.ctx.Err(); err != nil {
+			return 0, err
+		}
+		data, err := r.store.Get(r.ids[0])
+		if err != nil {
+			return 0, err
+		}
+		r.data, r.ids = data, r.ids[1:]
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
@@ -0,0 +1,109 @@
+package chunk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the codec used for new chunks ("" - no compression, "gzip" or "zstd")
+var Compression = ""
+
+// codecs maps supported compression codecs to extensions of chunk files
+var codecs = map[string]string{
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// incompressible lists extensions of already compressed formats, which are always stored as is
+var incompressible = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".avif": true, ".heic": true,
+	".mp3": true, ".ogg": true, ".opus": true, ".aac": true, ".flac": true, ".m4a": true,
+	".mp4": true, ".mkv": true, ".webm": true, ".avi": true, ".mov": true,
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".7z": true, ".rar": true,
+	".jar": true, ".apk": true, ".docx": true, ".xlsx": true, ".pptx": true, ".pdf": true,
+}
+
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+		return zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	})
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	})
+)
+
+// ValidCodec checks whether codec is supported
+func ValidCodec(codec string) error {
+	if _, ok := codecs[codec]; !ok && codec != "" {
+		return fmt.Errorf("unknown compression codec: %s, supported codecs are gzip and zstd", codec)
+	}
+	return nil
+}
+
+// codecFor returns codec to be used for file at path
+func codecFor(path string) string {
+	if incompressible[strings.ToLower(filepath.Ext(path))] {
+		return ""
+	}
+	return Compression
+}
+
+// compress compresses data with codec, returning nil if it is not worth it
+func compress(codec string, data []byte) ([]byte, error) {
+	var res []byte
+	switch codec {
+	case "gzip":
+		buf := bytes.Buffer{}
+		writer := gzip.NewWriter(&buf)
+		_, err := writer.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		err = writer.Close()
+		if err != nil {
+			return nil, err
+		}
+		res = buf.Bytes()
+	case "zstd":
+		encoder, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		res = encoder.EncodeAll(data, nil)
+	default:
+		return nil, nil
+	}
+	if len(res) >= len(data)-len(data)/32 { // random-looking data
+		return nil, nil
+	}
+	return res, nil
+}
+
+// decompress decompresses data of a chunk file with given extension
+func decompress(ext string, data []byte) ([]byte, error) {
+	switch ext {
+	case "":
+		return data, nil
+	case codecs["gzip"]:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	case codecs["zstd"]:
+		decoder, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return decoder.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unknown chunk file extension %q", ext)
+}
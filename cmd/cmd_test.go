@@ -1,16 +1,26 @@
 package cmd_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/SingularGamesStudio/backup/cmd/backup"
+	"github.com/SingularGamesStudio/backup/cmd/chunk"
+	"github.com/SingularGamesStudio/backup/cmd/crypt"
 	"github.com/SingularGamesStudio/backup/cmd/full"
 	"github.com/SingularGamesStudio/backup/cmd/incremental"
 	"github.com/SingularGamesStudio/backup/cmd/utils"
@@ -19,9 +29,13 @@ import (
 
 func TestFull(t *testing.T) {
 	utils.Yes = true
+	backup.UnsafeLinks = true // testdata links point outside of it
+	defer func() {
+		backup.UnsafeLinks = false
+	}()
 	_ = file.ClearDir(context.Background(), "testdata/backup")
 	full.Backup(context.Background(), "testdata/src", "testdata/backup")
-	folder, _ := incremental.Latest(context.Background(), "testdata/backup", true)
+	folder, _ := incremental.Latest(context.Background(), "testdata/backup", "full")
 	_ = full.Restore(context.Background(), "testdata/temp", folder)
 	defer func() {
 		_ = os.RemoveAll("testdata/temp")
@@ -34,11 +48,15 @@ func TestFull(t *testing.T) {
 func TestIncremental(t *testing.T) {
 	time.Sleep(2 * time.Second)
 	utils.Yes = true
+	backup.UnsafeLinks = true // testdata links point outside of it
+	defer func() {
+		backup.UnsafeLinks = false
+	}()
 	incremental.Backup(context.Background(), "testdata/src", "testdata/backup")
-	inc, _ := incremental.Latest(context.Background(), "testdata/backup", false)
+	inc, _ := incremental.Latest(context.Background(), "testdata/backup", "incremental")
 	info, _ := backup.GetJson(inc)
 	fmt.Println(inc, filepath.Join("testdata/backup", info.Base))
-	incremental.Restore(context.Background(), "testdata/temp", inc, filepath.Join("testdata/backup", info.Base))
+	incremental.Restore(context.Background(), "testdata/temp", inc)
 	defer func() {
 		_ = os.RemoveAll("testdata/temp")
 	}()
@@ -48,21 +66,1215 @@ func TestIncremental(t *testing.T) {
 	_ = file.ClearDir(context.Background(), "testdata/backup")
 }
 
-func checkSame(src string, dest string, t *testing.T) bool {
-	if filepath.Base(src) == ".backup.json" || filepath.Base(dest) == ".backup.json" {
-		return true
+func TestIncrementalChanges(t *testing.T) {
+	utils.Yes = true
+	src, dest := t.TempDir(), t.TempDir()
+	_ = os.MkdirAll(filepath.Join(src, "dir", "sub"), 0755)
+	_ = os.WriteFile(filepath.Join(src, "dir", "sub", "file"), []byte("data"), 0644)
+	_ = os.WriteFile(filepath.Join(src, "removed"), []byte("data"), 0644)
+	_ = os.WriteFile(filepath.Join(src, "notes.deleted"), []byte("data"), 0644)
+	full.Backup(context.Background(), src, dest)
+	time.Sleep(time.Second)
+	_ = os.Remove(filepath.Join(src, "removed"))
+	_ = os.WriteFile(filepath.Join(src, "notes.deleted"), []byte("more data"), 0644)
+	_ = os.WriteFile(filepath.Join(src, "added.deleted"), []byte("new data"), 0644) // same contents as removed would be a move
+	_ = os.RemoveAll(filepath.Join(src, "dir"))
+	_ = os.WriteFile(filepath.Join(src, "dir"), []byte("now a file"), 0644)
+	incremental.Backup(context.Background(), src, dest)
+	inc, _ := incremental.Latest(context.Background(), dest, "incremental")
+	manifest, _ := backup.GetManifest(inc)
+	changes := map[string]string{}
+	for _, entry := range manifest.Entries {
+		changes[entry.Path] = entry.Change
+	}
+	expected := map[string]string{
+		"removed":       backup.Deleted,
+		"notes.deleted": backup.Modified,
+		"added.deleted": backup.Added,
+		"dir":           backup.TypeChanged,
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected changes %v, got %v", expected, changes)
+	}
+	restored := filepath.Join(t.TempDir(), "restored")
+	incremental.Restore(context.Background(), restored, inc)
+	if !checkSame(src, restored, t) {
+		t.Error("dirs different")
+	}
+}
+
+func TestMoves(t *testing.T) {
+	utils.Yes = true
+	src, dest := t.TempDir(), t.TempDir()
+	_ = os.MkdirAll(filepath.Join(src, "textures"), 0755)
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(src, "textures", fmt.Sprint(i))
+		_ = os.WriteFile(path, []byte(fmt.Sprint("texture ", i)), 0644)
+		_ = os.Chtimes(path, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	}
+	_ = os.WriteFile(filepath.Join(src, "renamed"), []byte("same contents"), 0644)
+	full.Backup(context.Background(), src, dest)
+	time.Sleep(time.Second)
+	_ = os.MkdirAll(filepath.Join(src, "assets"), 0755)
+	_ = os.Rename(filepath.Join(src, "textures"), filepath.Join(src, "assets", "textures")) // found by index inode
+	_ = os.Remove(filepath.Join(src, "renamed"))
+	_ = os.WriteFile(filepath.Join(src, "copy"), []byte("same contents"), 0644) // found by hash
+	incremental.Backup(context.Background(), src, dest)
+	inc, _ := incremental.Latest(context.Background(), dest, "incremental")
+	manifest, _ := backup.GetManifest(inc)
+	moved := map[string]string{}
+	for _, entry := range manifest.Entries {
+		if entry.Change == backup.Moved {
+			moved[entry.Path] = entry.From
+		}
+	}
+	expected := map[string]string{
+		"assets/textures/0": "textures/0",
+		"assets/textures/1": "textures/1",
+		"assets/textures/2": "textures/2",
+		"copy":              "renamed",
+	}
+	if !reflect.DeepEqual(moved, expected) {
+		t.Errorf("expected moves %v, got %v", expected, moved)
+	}
+	restored := filepath.Join(t.TempDir(), "restored")
+	incremental.Restore(context.Background(), restored, inc)
+	if !checkSame(src, restored, t) {
+		t.Error("dirs different")
+	}
+}
+
+func TestMetadataChanges(t *testing.T) {
+	utils.Yes = true
+	src, dest := t.TempDir(), t.TempDir()
+	script := filepath.Join(src, "build.sh")
+	_ = os.WriteFile(script, []byte("echo ok"), 0644)
+	full.Backup(context.Background(), src, dest)
+	time.Sleep(time.Second)
+	_ = os.Chmod(script, 0755)
+	owned := runtime.GOOS != "windows" && os.Getuid() == 0
+	if owned {
+		_ = os.Lchown(script, 1234, 5678)
+	}
+	incremental.Backup(context.Background(), src, dest)
+	inc, _ := incremental.Latest(context.Background(), dest, "incremental")
+	manifest, _ := backup.GetManifest(inc)
+	if len(manifest.Entries) != 1 || manifest.Entries[0].Change != backup.MetadataChanged || len(manifest.Entries[0].Chunks) != 0 {
+		t.Fatalf("expected only metadata of build.sh to be saved, got %v", manifest.Entries)
+	}
+	restored := filepath.Join(t.TempDir(), "restored")
+	incremental.Restore(context.Background(), restored, inc)
+	if !checkSame(src, restored, t) {
+		t.Error("dirs different")
+	}
+	info, _ := os.Lstat(filepath.Join(restored, "build.sh"))
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("expected restored mode 0755, got %v", info.Mode().Perm())
+	}
+	if uid, gid := file.Owner(info); owned && (uid != 1234 || gid != 5678) {
+		t.Errorf("expected restored owner 1234:5678, got %d:%d", uid, gid)
+	}
+	resolved, _ := backup.Resolve(inc)
+	if len(resolved.Entries) != 1 || resolved.Entries[0].Mode.Perm() != 0755 || len(resolved.Entries[0].Chunks) != 1 {
+		t.Errorf("expected resolved entry with new mode and old contents, got %v", resolved.Entries)
+	}
+}
+
+func TestTypeChanges(t *testing.T) {
+	utils.Yes = true
+	src, dest := t.TempDir(), t.TempDir()
+	types := []string{"file", "dir", "symlink"}
+	create := func(name string, kind string, contents string) {
+		path := filepath.Join(src, name)
+		_ = os.RemoveAll(path)
+		switch kind {
+		case "file":
+			_ = os.WriteFile(path, []byte(contents), 0644)
+		case "dir":
+			_ = os.MkdirAll(filepath.Join(path, "inner"), 0755)
+			_ = os.WriteFile(filepath.Join(path, "inner", "file"), []byte(contents), 0644)
+		case "symlink":
+			_ = os.Symlink(contents, path)
+		}
+	}
+	_ = os.WriteFile(filepath.Join(src, "target"), []byte("target"), 0644)
+	for _, from := range types {
+		for _, to := range types {
+			if from != to {
+				create(from+"-to-"+to, from, "before "+from)
+			}
+		}
+	}
+	full.Backup(context.Background(), src, dest)
+	for step, reverse := range []bool{false, true} { // there and back again
+		time.Sleep(time.Second)
+		expected := map[string]string{}
+		for _, from := range types {
+			for _, to := range types {
+				if from == to {
+					continue
+				}
+				if reverse {
+					create(from+"-to-"+to, from, "back to "+from)
+				} else {
+					create(from+"-to-"+to, to, "after "+to)
+				}
+				expected[from+"-to-"+to] = backup.TypeChanged
+			}
+		}
+		incremental.Backup(context.Background(), src, dest)
+		inc, _ := incremental.Latest(context.Background(), dest, "incremental")
+		manifest, _ := backup.GetManifest(inc)
+		changes := map[string]string{}
+		for _, entry := range manifest.Entries {
+			if !strings.Contains(entry.Path, "/") {
+				changes[entry.Path] = entry.Change
+			}
+		}
+		if !reflect.DeepEqual(changes, expected) {
+			t.Errorf("step %d: expected changes %v, got %v", step, expected, changes)
+		}
+		restored := filepath.Join(t.TempDir(), "restored")
+		incremental.Restore(context.Background(), restored, inc)
+		if !checkSame(src, restored, t) {
+			t.Errorf("step %d: dirs different", step)
+		}
+	}
+	time.Sleep(time.Second)
+	incremental.Consolidate(context.Background(), dest)
+	consolidated, _ := incremental.Latest(context.Background(), dest)
+	restored := filepath.Join(t.TempDir(), "restored")
+	_ = full.Restore(context.Background(), restored, consolidated)
+	if !checkSame(src, restored, t) {
+		t.Error("dirs different after consolidation")
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	utils.Yes = true
+	defer func() {
+		backup.Symlinks = backup.Preserve
+		backup.UnsafeLinks = false
+	}()
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	_ = os.MkdirAll(filepath.Join(src, "dir"), 0755)
+	_ = os.WriteFile(filepath.Join(root, "outside"), []byte("outside"), 0644)
+	_ = os.WriteFile(filepath.Join(src, "target"), []byte("target"), 0644)
+	_ = os.WriteFile(filepath.Join(src, "dir", "inner"), []byte("inner"), 0644)
+	links := map[string]string{
+		"link":     "target",
+		"dirlink":  "dir",
+		"loop":     ".",
+		"dir/up":   "..",
+		"broken":   "missing",
+		"escape":   "../outside",
+		"abs":      filepath.Join(root, "outside"),
+		"chained":  "loop/../outside", // loop is ., so this is ../outside
+		"dir/back": "../target",
+	}
+	for name, target := range links {
+		_ = os.Symlink(target, filepath.Join(src, name))
+	}
+	saved := func(policy string) (string, map[string]backup.Entry) {
+		backup.Symlinks = policy
+		dest := t.TempDir()
+		full.Backup(context.Background(), src, dest)
+		latest, _ := incremental.Latest(context.Background(), dest)
+		manifest, _ := backup.GetManifest(latest)
+		entries := map[string]backup.Entry{}
+		for _, entry := range manifest.Entries {
+			entries[entry.Path] = entry
+		}
+		return latest, entries
+	}
+
+	latest, entries := saved(backup.Preserve)
+	for name, target := range links {
+		if entries[name].Link != target {
+			t.Errorf("preserve: expected %s to be saved as link to %s, got %+v", name, target, entries[name])
+		}
+	}
+	for _, unsafe := range []bool{false, true} {
+		backup.UnsafeLinks = unsafe
+		restored := filepath.Join(t.TempDir(), "restored")
+		_ = full.Restore(context.Background(), restored, latest)
+		for name, target := range links {
+			link, err := os.Readlink(filepath.Join(restored, name))
+			escaping := name == "escape" || name == "abs" || name == "chained"
+			if escaping && !unsafe && err == nil {
+				t.Errorf("link %s to %s outside of the restored folder is restored", name, link)
+			}
+			if (!escaping || unsafe) && link != target {
+				t.Errorf("unsafe %t: expected %s to be restored as link to %s, got %q (%v)", unsafe, name, target, link, err)
+			}
+		}
+	}
+
+	_, entries = saved(backup.Follow)
+	for name, contents := range map[string]string{"link": "target", "dirlink/inner": "inner", "escape": "outside", "abs": "outside"} {
+		if !entries[name].Mode.IsRegular() || entries[name].Size != int64(len(contents)) {
+			t.Errorf("follow: expected %s to be saved as file, got %+v", name, entries[name])
+		}
+	}
+	if !entries["dirlink"].Mode.IsDir() || entries["broken"].Link != "missing" {
+		t.Errorf("follow: expected directory and broken link, got %+v and %+v", entries["dirlink"], entries["broken"])
+	}
+	for _, name := range []string{"loop", "dir/up", "dirlink/up"} {
+		if _, ok := entries[name]; ok {
+			t.Errorf("follow: expected %s making a loop to be skipped", name)
+		}
+	}
+
+	_, entries = saved(backup.Skip)
+	for path, entry := range entries {
+		if entry.Mode&os.ModeSymlink != 0 {
+			t.Errorf("skip: link %s is saved", path)
+		}
+	}
+	if len(entries) != 3 {
+		t.Errorf("skip: expected 3 entries, got %v", entries)
+	}
+
+	backup.UnsafeLinks = true // even links allowed to point outside must not be written through
+	_ = os.MkdirAll(filepath.Join(root, "elsewhere"), 0755)
+	_ = backup.SaveManifest(latest, backup.Manifest{Entries: []backup.Entry{
+		{Path: "d", Mode: os.ModeSymlink | 0777, Link: "../elsewhere"},
+		{Path: "d/pwned", Mode: 0644},
+	}})
+	err := full.Restore(context.Background(), filepath.Join(root, "restored"), latest)
+	if !errors.Is(err, utils.ErrCorrupted) {
+		t.Errorf("expected entry inside a symlink to be refused, got %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "elsewhere", "pwned")); err == nil {
+		t.Error("file is written through a restored symlink")
+	}
+}
+
+func TestOneFileSystem(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs /proc, which is always a separate filesystem")
+	}
+	utils.Yes = true
+	backup.Symlinks, backup.OneFileSystem = backup.Follow, true // link to a mount point works like the mount itself
+	defer func() {
+		backup.Symlinks, backup.OneFileSystem = backup.Preserve, false
+	}()
+	src, dest := t.TempDir(), t.TempDir()
+	_ = os.MkdirAll(filepath.Join(src, "dir"), 0755)
+	_ = os.WriteFile(filepath.Join(src, "dir", "file"), []byte("file"), 0644)
+	_ = os.Symlink("/proc", filepath.Join(src, "proc"))
+	full.Backup(context.Background(), src, dest)
+	time.Sleep(time.Second)
+	_ = os.WriteFile(filepath.Join(src, "dir", "file"), []byte("changed"), 0644)
+	incremental.Backup(context.Background(), src, dest)
+	for _, kind := range []string{"full", "incremental"} {
+		latest, _ := incremental.Latest(context.Background(), dest, kind)
+		manifest, _ := backup.GetManifest(latest)
+		paths := []string{}
+		for _, entry := range manifest.Entries {
+			if strings.HasPrefix(entry.Path, "proc/") {
+				t.Errorf("%s: %s on another filesystem is saved", kind, entry.Path)
+			}
+			paths = append(paths, entry.Path)
+		}
+		if kind == "full" && !slices.Equal(paths, []string{"dir", "dir/file", "proc"}) {
+			t.Errorf("expected mount point itself to be saved, got %v", paths)
+		}
+	}
+}
+
+func TestExclude(t *testing.T) {
+	utils.Yes = true
+	backup.Exclude = []string{"secret.txt"}
+	defer func() {
+		backup.Exclude = nil
+	}()
+	src, dest := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		".backupignore":       "# build outputs\nbuild/\n*.tmp\n!keep.tmp\n/docs/**/*.pdf\n",
+		"sub/.backupignore":   "node_modules/\n!b.tmp\n",
+		"build/out.bin":       "",
+		"sub/build/out.bin":   "",
+		"a.tmp":               "",
+		"keep.tmp":            "",
+		"sub/b.tmp":           "",
+		"sub/node_modules/m":  "",
+		"node_modules":        "file, not a directory",
+		"docs/a/b.pdf":        "",
+		"docs/c.txt":          "",
+		"data.txt":            "data",
+		"secret.txt":          "",
+		"sub/deeper/c.tmp":    "",
+		"sub/deeper/keep.tmp": "",
+	}
+	for name, contents := range files {
+		_ = os.MkdirAll(filepath.Dir(filepath.Join(src, name)), 0755)
+		_ = os.WriteFile(filepath.Join(src, name), []byte(contents), 0644)
+	}
+	expected := []string{".backupignore", "data.txt", "docs", "docs/a", "docs/c.txt", "keep.tmp", "node_modules",
+		"sub", "sub/.backupignore", "sub/b.tmp", "sub/deeper", "sub/deeper/keep.tmp"}
+	full.Backup(context.Background(), src, dest)
+	latest, _ := incremental.Latest(context.Background(), dest)
+	manifest, _ := backup.GetManifest(latest)
+	paths := []string{}
+	for _, entry := range manifest.Entries {
+		paths = append(paths, entry.Path)
+	}
+	if !slices.Equal(paths, expected) {
+		t.Errorf("expected %v to be saved, got %v", expected, paths)
+	}
+
+	time.Sleep(time.Second)
+	_ = os.WriteFile(filepath.Join(src, ".backupignore"), []byte("build/\n*.tmp\n!keep.tmp\n/docs/**/*.pdf\ndata.txt\n"), 0644)
+	_ = os.Remove(filepath.Join(src, "docs", "c.txt"))
+	incremental.Backup(context.Background(), src, dest)
+	inc, _ := incremental.Latest(context.Background(), dest, "incremental")
+	manifest, _ = backup.GetManifest(inc)
+	changes := map[string]string{}
+	for _, entry := range manifest.Entries {
+		changes[entry.Path] = entry.Change
+	}
+	if changes["docs/c.txt"] != backup.Deleted || changes[".backupignore"] != backup.Modified {
+		t.Errorf("expected deleted file and modified ignore file, got %v", changes)
+	}
+	if _, ok := changes["data.txt"]; ok {
+		t.Errorf("newly excluded file is saved as %s", changes["data.txt"])
+	}
+	restored := filepath.Join(t.TempDir(), "restored")
+	incremental.Restore(context.Background(), restored, inc)
+	if data, err := os.ReadFile(filepath.Join(restored, "data.txt")); string(data) != "data" {
+		t.Errorf("expected excluded file to be restored from the base backup, got %q (%v)", data, err)
+	}
+}
+
+func TestGitIgnore(t *testing.T) {
+	utils.Yes = true
+	defer func() {
+		backup.GitIgnore, backup.ExcludeCaches = false, false
+	}()
+	src := t.TempDir()
+	files := map[string]string{
+		".gitignore":         "*.o\n/bin/\n",
+		".backupignore":      "!bin/\n",
+		"sub/.gitignore":     "!keep.o\n",
+		"main.o":             "",
+		"sub/keep.o":         "",
+		"sub/other.o":        "",
+		"bin/app":            "",
+		"cache/CACHEDIR.TAG": "Signature: 8a477f597d28d172789f06886806bc55\n# This file is a cache directory tag.\n",
+		"cache/blob":         "",
+		"fake/CACHEDIR.TAG":  "Signature: not a cache",
+		"fake/blob":          "",
+	}
+	for name, contents := range files {
+		_ = os.MkdirAll(filepath.Dir(filepath.Join(src, name)), 0755)
+		_ = os.WriteFile(filepath.Join(src, name), []byte(contents), 0644)
+	}
+	saved := func() []string {
+		dest := t.TempDir()
+		full.Backup(context.Background(), src, dest)
+		latest, _ := incremental.Latest(context.Background(), dest)
+		manifest, _ := backup.GetManifest(latest)
+		paths := []string{}
+		for _, entry := range manifest.Entries {
+			paths = append(paths, entry.Path)
+		}
+		return paths
+	}
+	if paths := saved(); len(paths) != len(files)+4 { // with directories
+		t.Errorf("expected everything to be saved without --gitignore and --exclude-caches, got %v", paths)
+	}
+	backup.GitIgnore, backup.ExcludeCaches = true, true
+	expected := []string{".backupignore", ".gitignore", "bin", "bin/app", "fake", "fake/CACHEDIR.TAG", "fake/blob",
+		"sub", "sub/.gitignore", "sub/keep.o"}
+	if paths := saved(); !slices.Equal(paths, expected) {
+		t.Errorf("expected %v to be saved, got %v", expected, paths)
+	}
+}
+
+func TestTimes(t *testing.T) {
+	utils.Yes = true
+	defer func() {
+		backup.Times = true
+	}()
+	src, dest := t.TempDir(), t.TempDir()
+	dir, path, link := filepath.Join(src, "dir"), filepath.Join(src, "dir", "file"), filepath.Join(src, "dir", "link")
+	_ = os.MkdirAll(dir, 0755)
+	_ = os.WriteFile(path, []byte("data"), 0644)
+	_ = os.Symlink("file", link)
+	mtime, atime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	_ = os.Chtimes(path, atime, mtime)
+	if runtime.GOOS != "windows" {
+		_ = file.SetTimes(link, os.ModeSymlink, atime, mtime.Add(time.Hour))
+	}
+	_ = os.Chtimes(dir, atime, mtime.Add(2*time.Hour))
+	full.Backup(context.Background(), src, dest)
+	time.Sleep(time.Second)
+	_ = os.WriteFile(filepath.Join(dir, "added"), []byte("data"), 0644)
+	_ = os.Chtimes(dir, atime, mtime.Add(3*time.Hour))
+	incremental.Backup(context.Background(), src, dest)
+	inc, _ := incremental.Latest(context.Background(), dest, "incremental")
+	restored := filepath.Join(t.TempDir(), "restored")
+	incremental.Restore(context.Background(), restored, inc)
+	for _, rel := range []string{"dir", "dir/file", "dir/link"} {
+		expected, _ := os.Lstat(filepath.Join(src, rel))
+		actual, err := os.Lstat(filepath.Join(restored, rel))
+		if err != nil || !actual.ModTime().Equal(expected.ModTime()) {
+			t.Errorf("%s: expected mtime %v, got %v (%v)", rel, expected.ModTime(), actual.ModTime(), err)
+		}
+	}
+	info, _ := os.Lstat(filepath.Join(restored, "dir", "file"))
+	if !file.AccessTime(info).Equal(atime) {
+		t.Errorf("expected atime %v, got %v", atime, file.AccessTime(info))
+	}
+	backup.Times = false
+	restored = filepath.Join(t.TempDir(), "restored")
+	incremental.Restore(context.Background(), restored, inc)
+	info, _ = os.Lstat(filepath.Join(restored, "dir", "file"))
+	if info.ModTime().Equal(mtime) {
+		t.Error("expected times not to be restored")
+	}
+}
+
+func TestXattrs(t *testing.T) {
+	utils.Yes = true
+	defer func() {
+		backup.Xattrs = false
+	}()
+	src, dest := t.TempDir(), t.TempDir()
+	path := filepath.Join(src, "tagged")
+	_ = os.WriteFile(path, []byte("data"), 0644)
+	attrs := map[string][]byte{"user.tag": []byte("texture")}
+	if err := file.SetXattrs(path, attrs); err != nil {
+		t.Skipf("extended attributes are not supported: %v", err)
+	}
+	// POSIX ACL granting read access to uid 1234: user::rw-, user:1234:r--, group::r--, mask::r--, other::r--
+	acl := binary.LittleEndian.AppendUint32(nil, 2)
+	for _, e := range [][3]uint32{{0x01, 6, math.MaxUint32}, {0x02, 4, 1234}, {0x04, 4, math.MaxUint32}, {0x10, 4, math.MaxUint32}, {0x20, 4, math.MaxUint32}} {
+		acl = binary.LittleEndian.AppendUint16(binary.LittleEndian.AppendUint16(acl, uint16(e[0])), uint16(e[1]))
+		acl = binary.LittleEndian.AppendUint32(acl, e[2])
+	}
+	attrs["system.posix_acl_access"] = acl
+	if err := file.SetXattrs(path, attrs); err != nil {
+		delete(attrs, "system.posix_acl_access")
+		t.Logf("POSIX ACLs are not supported: %v", err)
+	}
+	readonly := filepath.Join(src, "readonly") // attributes can not be set on it without privileges after its mode is
+	_ = os.WriteFile(readonly, []byte("data"), 0644)
+	_ = file.SetXattrs(readonly, map[string][]byte{"user.tag": []byte("texture")})
+	_ = os.Chmod(readonly, 0444)
+	backup.Xattrs = true
+	full.Backup(context.Background(), src, dest)
+	time.Sleep(time.Second)
+	attrs["user.tag"] = []byte("model")
+	_ = file.SetXattrs(path, attrs)
+	_ = os.Chmod(readonly, 0644)
+	_ = file.SetXattrs(readonly, map[string][]byte{"user.tag": []byte("model")})
+	_ = os.Chmod(readonly, 0444)
+	incremental.Backup(context.Background(), src, dest)
+	inc, _ := incremental.Latest(context.Background(), dest, "incremental")
+	manifest, _ := backup.GetManifest(inc)
+	if len(manifest.Entries) != 2 || manifest.Entries[0].Change != backup.MetadataChanged || manifest.Entries[1].Change != backup.MetadataChanged {
+		t.Errorf("expected attribute changes to be saved as metadata changes, got %v", manifest.Entries)
+	}
+	restored := filepath.Join(t.TempDir(), "restored")
+	incremental.Restore(context.Background(), restored, inc)
+	actual, err := file.Xattrs(filepath.Join(restored, "tagged"))
+	if err != nil || !reflect.DeepEqual(actual, attrs) {
+		t.Errorf("expected restored attributes %v, got %v (%v)", attrs, actual, err)
+	}
+	actual, err = file.Xattrs(filepath.Join(restored, "readonly"))
+	if info, _ := os.Lstat(filepath.Join(restored, "readonly")); err != nil || string(actual["user.tag"]) != "model" || info.Mode().Perm() != 0444 {
+		t.Errorf("expected read-only file to get its attributes, got %v (%v)", actual, err)
+	}
+
+	backup.Xattrs = false
+	time.Sleep(time.Second)
+	_ = os.Chmod(path, 0600)
+	incremental.Backup(context.Background(), src, dest)
+	inc, _ = incremental.Latest(context.Background(), dest, "incremental")
+	resolved, _ := backup.Resolve(inc)
+	for _, entry := range resolved.Entries {
+		if entry.Path == "tagged" && !reflect.DeepEqual(entry.Xattrs, attrs) {
+			t.Errorf("expected attributes to be kept by a backup without them, got %v", entry.Xattrs)
+		}
+	}
+}
+
+func TestHardLinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hard links are only detected on unix")
+	}
+	utils.Yes = true
+	src, dest := t.TempDir(), t.TempDir()
+	_ = os.MkdirAll(filepath.Join(src, "dir"), 0755)
+	_ = os.WriteFile(filepath.Join(src, "a"), []byte("shared"), 0644)
+	_ = os.Link(filepath.Join(src, "a"), filepath.Join(src, "b"))
+	_ = os.Link(filepath.Join(src, "a"), filepath.Join(src, "dir", "c"))
+	full.Backup(context.Background(), src, dest)
+	latest, _ := incremental.Latest(context.Background(), dest)
+	manifest, _ := backup.GetManifest(latest)
+	links := map[string]string{}
+	for _, entry := range manifest.Entries {
+		if entry.LinkTo != "" {
+			links[entry.Path] = entry.LinkTo
+		}
+	}
+	if expected := map[string]string{"b": "a", "dir/c": "a"}; !reflect.DeepEqual(links, expected) {
+		t.Errorf("expected hard links %v, got %v", expected, links)
+	}
+	time.Sleep(time.Second)
+	_ = os.Link(filepath.Join(src, "a"), filepath.Join(src, "d"))
+	_ = os.Remove(filepath.Join(src, "b"))
+	_ = os.WriteFile(filepath.Join(src, "b"), []byte("shared"), 0644) // same contents, but not a link anymore
+	incremental.Backup(context.Background(), src, dest)
+	inc, _ := incremental.Latest(context.Background(), dest, "incremental")
+	restored := filepath.Join(t.TempDir(), "restored")
+	incremental.Restore(context.Background(), restored, inc)
+	if !checkSame(src, restored, t) {
+		t.Error("dirs different")
+	}
+	same := func(restored string, name string, other string) bool {
+		info, _ := os.Lstat(filepath.Join(restored, name))
+		otherInfo, err := os.Lstat(filepath.Join(restored, other))
+		return err == nil && os.SameFile(info, otherInfo)
+	}
+	if !same(restored, "a", "dir/c") || !same(restored, "a", "d") || same(restored, "a", "b") {
+		t.Errorf("expected dir/c and d to be links to a, but not b: %v %v %v",
+			same(restored, "a", "dir/c"), same(restored, "a", "d"), same(restored, "a", "b"))
+	}
+
+	_ = os.WriteFile(filepath.Join(src, "z"), []byte("last"), 0644)
+	for _, name := range []string{"x", "y"} { // same contents and mtime, but not links yet
+		_ = os.WriteFile(filepath.Join(src, name), []byte("copy"), 0644)
+		_ = os.Chtimes(filepath.Join(src, name), time.Time{}, time.Unix(1e9, 0))
+	}
+	time.Sleep(time.Second)
+	incremental.Backup(context.Background(), src, dest)
+	time.Sleep(time.Second)
+	_ = os.Link(filepath.Join(src, "z"), filepath.Join(src, "e")) // found before the unchanged file it links to
+	_ = os.Remove(filepath.Join(src, "x"))
+	_ = os.Link(filepath.Join(src, "y"), filepath.Join(src, "x")) // looks unchanged, but is a link now
+	incremental.Backup(context.Background(), src, dest)
+	inc, _ = incremental.Latest(context.Background(), dest, "incremental")
+	restored = filepath.Join(t.TempDir(), "restored")
+	incremental.Restore(context.Background(), restored, inc)
+	if !checkSame(src, restored, t) {
+		t.Error("dirs different")
+	}
+	if !same(restored, "e", "z") || !same(restored, "x", "y") {
+		t.Errorf("expected new links to unchanged files to be restored: %v %v", same(restored, "e", "z"), same(restored, "x", "y"))
+	}
+}
+
+func TestChain(t *testing.T) {
+	utils.Yes = true
+	src, dest := t.TempDir(), t.TempDir()
+	_ = os.WriteFile(filepath.Join(src, "first"), []byte("data"), 0644)
+	full.Backup(context.Background(), src, dest)
+	var backups []string
+	for i, change := range []func(){
+		func() { _ = os.WriteFile(filepath.Join(src, "second"), []byte("data"), 0644) },
+		func() { _ = os.WriteFile(filepath.Join(src, "first"), []byte("more data"), 0644) },
+		func() { _ = os.Remove(filepath.Join(src, "second")) },
+	} {
+		time.Sleep(time.Second)
+		change()
+		incremental.Backup(context.Background(), src, dest)
+		inc, _ := incremental.Latest(context.Background(), dest)
+		manifest, _ := backup.GetManifest(inc)
+		if len(manifest.Entries) != 1 {
+			t.Errorf("backup %d: expected only 1 change, got %v", i, manifest.Entries)
+		}
+		backups = append(backups, inc)
+	}
+	info, _ := backup.GetJson(backups[2])
+	if info.Parent != filepath.Base(backups[1]) {
+		t.Errorf("expected parent %s, got %s", filepath.Base(backups[1]), info.Parent)
+	}
+	restored := filepath.Join(t.TempDir(), "restored")
+	incremental.Restore(context.Background(), restored, backups[2])
+	if !checkSame(src, restored, t) {
+		t.Error("dirs different")
+	}
+}
+
+func TestDifferential(t *testing.T) {
+	utils.Yes = true
+	src, dest := t.TempDir(), t.TempDir()
+	full.Backup(context.Background(), src, dest)
+	base, _ := incremental.Latest(context.Background(), dest, "full")
+	time.Sleep(time.Second)
+	_ = os.WriteFile(filepath.Join(src, "first"), []byte("data"), 0644)
+	incremental.Backup(context.Background(), src, dest)
+	time.Sleep(time.Second)
+	_ = os.WriteFile(filepath.Join(src, "second"), []byte("data"), 0644)
+	incremental.Differential(context.Background(), src, dest)
+	diff, _ := incremental.Latest(context.Background(), dest, "differential")
+	info, _ := backup.GetJson(diff)
+	manifest, _ := backup.GetManifest(diff)
+	if info.Parent != filepath.Base(base) || len(manifest.Entries) != 2 {
+		t.Errorf("differential backup is not based on full: parent %s, changes %v", info.Parent, manifest.Entries)
 	}
+	restored := filepath.Join(t.TempDir(), "restored")
+	incremental.Restore(context.Background(), restored, diff)
+	if !checkSame(src, restored, t) {
+		t.Error("dirs different")
+	}
+}
+
+func TestConsolidate(t *testing.T) {
+	utils.Yes = true
+	src, dest := t.TempDir(), t.TempDir()
+	_ = os.WriteFile(filepath.Join(src, "first"), []byte("data"), 0644)
+	full.Backup(context.Background(), src, dest)
+	time.Sleep(time.Second)
+	_ = os.WriteFile(filepath.Join(src, "second"), []byte("data"), 0644)
+	incremental.Backup(context.Background(), src, dest)
+	inc, _ := incremental.Latest(context.Background(), dest)
+	time.Sleep(time.Second)
+	incremental.Consolidate(context.Background(), dest)
+	consolidated, _ := incremental.Latest(context.Background(), dest)
+	info, _ := backup.GetJson(consolidated)
+	if info.Type != "full" || info.Source != filepath.Base(inc) {
+		t.Fatalf("expected full backup consolidated from %s, got %v", filepath.Base(inc), info)
+	}
+	restored := filepath.Join(t.TempDir(), "restored")
+	_ = full.Restore(context.Background(), restored, consolidated)
+	if !checkSame(src, restored, t) {
+		t.Error("dirs different")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	utils.Yes = true
+	defer func() {
+		incremental.Checksum = false
+	}()
+	src, dest := t.TempDir(), t.TempDir()
+	path, touched := filepath.Join(src, "config"), filepath.Join(src, "touched")
+	_ = os.WriteFile(path, []byte("value=1"), 0644)
+	_ = os.WriteFile(touched, []byte("same"), 0644)
+	full.Backup(context.Background(), src, dest)
+	for step, checksum := range []bool{false, true} {
+		_ = os.WriteFile(path, []byte(fmt.Sprintf("value=%d", step+2)), 0644) // same size, older mtime
+		_ = os.Chtimes(path, time.Now().Add(-time.Hour*time.Duration(step+1)), time.Now().Add(-time.Hour*time.Duration(step+1)))
+		_ = os.Chtimes(touched, time.Now().Add(time.Hour*time.Duration(step+1)), time.Now().Add(time.Hour*time.Duration(step+1)))
+		incremental.Checksum = checksum
+		time.Sleep(time.Second)
+		incremental.Backup(context.Background(), src, dest)
+		inc, _ := incremental.Latest(context.Background(), dest, "incremental")
+		manifest, _ := backup.GetManifest(inc)
+		changes := map[string]string{}
+		for _, entry := range manifest.Entries {
+			changes[entry.Path] = entry.Change
+		}
+		expected := map[string]string{"config": backup.Modified, "touched": backup.MetadataChanged}
+		if !checksum { // without hashes, changed mtime has to mean changed contents
+			expected["touched"] = backup.Modified
+		}
+		if !reflect.DeepEqual(changes, expected) {
+			t.Errorf("checksum=%v: expected changes %v, got %v", checksum, expected, changes)
+		}
+	}
+	inc, _ := incremental.Latest(context.Background(), dest, "incremental")
+	restored := filepath.Join(t.TempDir(), "restored")
+	incremental.Restore(context.Background(), restored, inc)
+	if !checkSame(src, restored, t) {
+		t.Error("dirs different")
+	}
+}
+
+func TestSameSizeEdit(t *testing.T) {
+	utils.Yes = true
+	defer func() {
+		incremental.Checksum = false
+	}()
+	src, dest := t.TempDir(), t.TempDir()
+	path := filepath.Join(src, "config")
+	_ = os.WriteFile(path, []byte("value=1"), 0644)
+	_ = os.Link(path, filepath.Join(src, "link"))
+	full.Backup(context.Background(), src, dest)
+	time.Sleep(time.Second)
+	_ = os.WriteFile(path, []byte("value=2"), 0644) // same size and inode, newer mtime
+	for _, checksum := range []bool{false, true} {
+		incremental.Checksum = checksum
+		time.Sleep(time.Second)
+		incremental.Backup(context.Background(), src, dest)
+	}
+	inc, _ := incremental.Latest(context.Background(), dest, "incremental")
+	restored := filepath.Join(t.TempDir(), "restored")
+	incremental.Restore(context.Background(), restored, inc)
+	for _, name := range []string{"config", "link"} {
+		if data, _ := os.ReadFile(filepath.Join(restored, name)); string(data) != "value=2" {
+			t.Errorf("expected edit of %s to be restored, got %q", name, data)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	utils.Yes = true
+	src, dest := t.TempDir(), t.TempDir()
+	old, fresh := filepath.Join(src, "old"), filepath.Join(src, "fresh")
+	_ = os.WriteFile(old, []byte("old contents"), 0644)
+	_ = os.Chtimes(old, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	_ = os.WriteFile(fresh, []byte("fresh contents"), 0644)
+	full.Backup(context.Background(), src, dest)
+	index, err := backup.LoadIndex(dest, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldInfo, _ := os.Lstat(old)
+	record, ok := index.Lookup("old", oldInfo)
+	hash, _ := file.Hash(context.Background(), old)
+	if !ok || record.Hash != hash || len(record.Chunks) != 1 {
+		t.Errorf("expected index record for old file, got %v", record)
+	}
+	freshInfo, _ := os.Lstat(fresh)
+	if _, ok := index.Lookup("fresh", freshInfo); ok {
+		t.Error("file modified just before backup must not be trusted by index")
+	}
+	_ = os.WriteFile(old, []byte("new contents"), 0644) // same size and mtime, only ctime differs
+	_ = os.Chtimes(old, oldInfo.ModTime(), oldInfo.ModTime())
+	oldInfo, _ = os.Lstat(old)
+	if _, ok := index.Lookup("old", oldInfo); ok {
+		t.Error("index record of rewritten file must not match")
+	}
+	time.Sleep(time.Second)
+	full.Backup(context.Background(), src, dest)
+	latest, _ := incremental.Latest(context.Background(), dest)
+	restored := filepath.Join(t.TempDir(), "restored")
+	_ = full.Restore(context.Background(), restored, latest)
+	if !checkSame(src, restored, t) {
+		t.Error("dirs different")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	utils.Yes = true
+	_ = file.ClearDir(context.Background(), "testdata/backup")
+	defer func() {
+		_ = file.ClearDir(context.Background(), "testdata/backup")
+	}()
+	full.Backup(context.Background(), "testdata/src", "testdata/backup")
+	before := countFiles("testdata/backup/chunks")
+	time.Sleep(time.Second)
+	full.Backup(context.Background(), "testdata/src", "testdata/backup")
+	if before == 0 || countFiles("testdata/backup/chunks") != before {
+		t.Errorf("chunks not deduplicated: %d before, %d after", before, countFiles("testdata/backup/chunks"))
+	}
+}
+
+func TestChunkedEdit(t *testing.T) {
+	utils.Yes = true
+	src, dest := t.TempDir(), t.TempDir()
+	data := make([]byte, 8<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	err := os.WriteFile(filepath.Join(src, "asset.pak"), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full.Backup(context.Background(), src, dest)
+	before := countFiles(filepath.Join(dest, "chunks"))
+	time.Sleep(time.Second)
+	edited := append(append(append([]byte{}, data[:4<<20]...), "edit"...), data[4<<20:]...)
+	err = os.WriteFile(filepath.Join(src, "asset.pak"), edited, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	incremental.Backup(context.Background(), src, dest)
+	if added := countFiles(filepath.Join(dest, "chunks")) - before; added < 1 || added > 2 {
+		t.Errorf("expected 1-2 new chunks after edit, got %d (of %d)", added, before)
+	}
+	inc, _ := incremental.Latest(context.Background(), dest, "incremental")
+	restored := filepath.Join(t.TempDir(), "restored")
+	incremental.Restore(context.Background(), restored, inc)
+	if !checkSame(src, restored, t) {
+		t.Error("dirs different")
+	}
+}
+
+func TestDelta(t *testing.T) {
+	utils.Yes = true
+	defer func() {
+		incremental.Delta = false
+	}()
+	src, dest := t.TempDir(), t.TempDir()
+	path := filepath.Join(src, "save.db")
+	data := make([]byte, 3<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	_ = os.WriteFile(path, data, 0644)
+	full.Backup(context.Background(), src, dest)
+	incremental.Delta = true
+	for i, edit := range []string{"first edit", "second"} {
+		time.Sleep(time.Second)
+		data = append(append(append([]byte{}, data[:(i+1)<<20]...), edit...), data[(i+1)<<20+100:]...)
+		_ = os.WriteFile(path, data, 0644)
+		incremental.Backup(context.Background(), src, dest)
+		inc, _ := incremental.Latest(context.Background(), dest, "incremental")
+		manifest, _ := backup.GetManifest(inc)
+		if len(manifest.Entries) != 1 || len(manifest.Entries[0].Delta) != 1 || len(manifest.Entries[0].Chunks) != 0 {
+			t.Fatalf("expected save.db to be saved as delta, got %v", manifest.Entries)
+		}
+		restored := filepath.Join(t.TempDir(), "restored")
+		incremental.Restore(context.Background(), restored, inc)
+		if !checkSame(src, restored, t) {
+			t.Error("dirs different")
+		}
+	}
+	time.Sleep(time.Second)
+	incremental.Consolidate(context.Background(), dest)
+	consolidated, _ := incremental.Latest(context.Background(), dest)
+	restored := filepath.Join(t.TempDir(), "restored")
+	_ = full.Restore(context.Background(), restored, consolidated)
+	if !checkSame(src, restored, t) {
+		t.Error("dirs different after consolidation")
+	}
+}
+
+func TestSparse(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("holes are only detected on linux")
+	}
+	utils.Yes = true
+	src, dest := t.TempDir(), t.TempDir()
+	image := filepath.Join(src, "disk.img")
+	f, _ := os.Create(image)
+	_ = f.Truncate(256 << 20)
+	_, _ = f.WriteAt([]byte("boot sector"), 0)
+	_, _ = f.WriteAt([]byte("partition table"), 128<<20)
+	_ = f.Close()
+	_ = os.WriteFile(filepath.Join(src, "empty.img"), nil, 0644)
+	_ = os.Truncate(filepath.Join(src, "empty.img"), 64<<20)
+	full.Backup(context.Background(), src, dest)
+	latest, _ := incremental.Latest(context.Background(), dest)
+	manifest, _ := backup.GetManifest(latest)
+	for _, entry := range manifest.Entries {
+		if entry.Extents == nil {
+			t.Skipf("filesystem does not report holes in %s", entry.Path)
+		}
+	}
+	if size := dirSize(filepath.Join(dest, utils.Chunks)); size > 16<<20 {
+		t.Errorf("expected holes not to be saved, chunks take %d bytes", size)
+	}
+	restored := filepath.Join(t.TempDir(), "restored")
+	_ = full.Restore(context.Background(), restored, latest)
+	if !checkSame(src, restored, t) {
+		t.Error("dirs different")
+	}
+	for _, name := range []string{"disk.img", "empty.img"} {
+		info, _ := os.Lstat(filepath.Join(restored, name))
+		if blocks := reflect.ValueOf(info.Sys()).Elem().FieldByName("Blocks").Int(); blocks*512 > 16<<20 {
+			t.Errorf("expected restored %s to be sparse, it takes %d bytes", name, blocks*512)
+		}
+	}
+}
+
+func TestSpecialFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("special files can not be created on windows")
+	}
+	utils.Yes = true
+	src, dest := t.TempDir(), t.TempDir()
+	_ = file.Mknod(filepath.Join(src, "fifo"), os.ModeNamedPipe|0644, 0, 0)
+	_ = file.Mknod(filepath.Join(src, "socket"), os.ModeSocket|0755, 0, 0)
+	devices := file.Mknod(filepath.Join(src, "null"), os.ModeDevice|os.ModeCharDevice|0666, 1, 3) == nil // only root can create devices
+	done := make(chan struct{})
+	go func() {
+		full.Backup(context.Background(), src, dest)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("backup blocked on a special file")
+	}
+	latest, _ := incremental.Latest(context.Background(), dest)
+	restored := filepath.Join(t.TempDir(), "restored")
+	_ = full.Restore(context.Background(), restored, latest)
+	if !checkSame(src, restored, t) {
+		t.Error("dirs different")
+	}
+	skipped := backup.Entry{Path: "skipped", Mode: os.ModeDevice | 0666, Change: backup.MetadataChanged} // as restored without root
+	if err := backup.ApplyEntry(context.Background(), nil, skipped, t.TempDir()); err != nil {
+		t.Error("metadata change of a device, which was not restored, failed:", err)
+	}
+	if !devices {
+		return
+	}
+	check := func(restored string, major uint32, minor uint32) {
+		info, err := os.Lstat(filepath.Join(restored, "null"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if major2, minor2 := file.Device(info); major2 != major || minor2 != minor {
+			t.Errorf("expected device %d:%d, got %d:%d", major, minor, major2, minor2)
+		}
+	}
+	check(restored, 1, 3)
+	time.Sleep(time.Second)
+	_ = os.Remove(filepath.Join(src, "null"))
+	_ = file.Mknod(filepath.Join(src, "null"), os.ModeDevice|os.ModeCharDevice|0666, 1, 5)
+	incremental.Backup(context.Background(), src, dest)
+	inc, _ := incremental.Latest(context.Background(), dest, "incremental")
+	manifest, _ := backup.GetManifest(inc)
+	if len(manifest.Entries) != 1 || manifest.Entries[0].Change != backup.Modified {
+		t.Errorf("expected device to be modified, got %v", manifest.Entries)
+	}
+	restored = filepath.Join(t.TempDir(), "restored")
+	incremental.Restore(context.Background(), restored, inc)
+	check(restored, 1, 5)
+}
+
+func TestTamperedPaths(t *testing.T) {
+	utils.Yes = true
+	root := t.TempDir()
+	src, dest := filepath.Join(root, "src"), filepath.Join(root, "dest")
+	_ = os.MkdirAll(src, 0755)
+	_ = os.WriteFile(filepath.Join(src, "file"), []byte("file"), 0644)
+	full.Backup(context.Background(), src, dest)
+	latest, _ := incremental.Latest(context.Background(), dest)
+	manifest, _ := backup.GetManifest(latest)
+	for _, tampered := range []backup.Entry{
+		{Path: "../pwned", Mode: 0644, Chunks: manifest.Entries[0].Chunks},
+		{Path: "file", Mode: 0644, LinkTo: "../../etc/passwd"},
+		{Path: "/pwned", Mode: 0644},
+		{Path: "short", Mode: 0644, Chunks: []string{"a"}},
+		{Path: "traversal", Mode: 0644, Chunks: []string{strings.Repeat("../", 20) + "pwne"}},
+	} {
+		_ = backup.SaveManifest(latest, backup.Manifest{Entries: []backup.Entry{tampered}})
+		restored := filepath.Join(root, "restored")
+		err := full.Restore(context.Background(), restored, latest)
+		if !errors.Is(err, utils.ErrCorrupted) {
+			t.Errorf("%s%s: expected tampered manifest to be refused, got %v", tampered.Path, tampered.LinkTo, err)
+		}
+		if _, err := os.Lstat(filepath.Join(root, "pwned")); err == nil {
+			t.Fatalf("%s%s: file outside of the restored folder is written", tampered.Path, tampered.LinkTo)
+		}
+	}
+	_ = backup.SaveInfo(latest, backup.Info{Type: "incremental", Parent: "../../elsewhere"})
+	if _, err := backup.Chain(latest); !errors.Is(err, utils.ErrCorrupted) {
+		t.Errorf("expected parent outside of the backup folder to be refused, got %v", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	utils.Yes = true
+	for _, codec := range []string{"gzip", "zstd"} {
+		chunk.Compression = codec
+		src, dest := t.TempDir(), t.TempDir()
+		text := bytes.Repeat([]byte("all work and no play makes jack a dull boy\n"), 1000)
+		_ = os.WriteFile(filepath.Join(src, "text.txt"), text, 0644)
+		_ = os.WriteFile(filepath.Join(src, "image.png"), append(text, '!'), 0644)
+		full.Backup(context.Background(), src, dest)
+		chunk.Compression = ""
+		compressed, raw := 0, 0
+		_ = filepath.WalkDir(filepath.Join(dest, "chunks"), func(path string, d os.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				if filepath.Ext(path) == "" {
+					raw++
+				} else {
+					compressed++
+				}
+			}
+			return nil
+		})
+		if compressed != 1 || raw != 1 {
+			t.Errorf("%s: expected 1 compressed and 1 raw chunk, got %d and %d", codec, compressed, raw)
+		}
+		folder, _ := incremental.Latest(context.Background(), dest, "full")
+		info, _ := backup.GetJson(folder)
+		if info.Compression != codec {
+			t.Errorf("%s: compression not saved in metadata: %q", codec, info.Compression)
+		}
+		restored := filepath.Join(t.TempDir(), "restored")
+		_ = full.Restore(context.Background(), restored, folder)
+		if !checkSame(src, restored, t) {
+			t.Errorf("%s: dirs different", codec)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	utils.Yes = true
+	backup.UnsafeLinks = true // testdata links point outside of it
+	crypt.Encrypt = true
+	defer func() {
+		backup.UnsafeLinks = false
+		crypt.Encrypt = false
+	}()
+	t.Setenv(crypt.PassphraseEnv, "correct horse battery staple")
+	dest := t.TempDir()
+	full.Backup(context.Background(), "testdata/src", dest)
+	folder, _ := incremental.Latest(context.Background(), dest, "full")
+	for _, name := range []string{utils.Metadata, utils.Manifest} {
+		data, _ := os.ReadFile(filepath.Join(folder, name))
+		if len(data) == 0 || bytes.Contains(data, []byte("abiba")) || bytes.Contains(data, []byte("full")) {
+			t.Errorf("%s is not encrypted", name)
+		}
+	}
+	restored := filepath.Join(t.TempDir(), "restored")
+	err := full.Restore(context.Background(), restored, folder)
+	if err != nil || !checkSame("testdata/src", restored, t) {
+		t.Fatal("dirs different", err)
+	}
+
+	time.Sleep(time.Second)
+	full.Backup(context.Background(), t.TempDir(), dest)
+	second, _ := incremental.Latest(context.Background(), dest, "full")
+	data, _ := os.ReadFile(filepath.Join(folder, utils.Manifest))
+	_ = os.WriteFile(filepath.Join(second, utils.Manifest), data, 0644)
+	err = full.Restore(context.Background(), filepath.Join(t.TempDir(), "restored"), second)
+	if !errors.Is(err, utils.ErrCorrupted) {
+		t.Error("manifest of another backup accepted:", err)
+	}
+
+	other := filepath.Join(t.TempDir(), "other") // unlocked keys are cached by path
+	err = os.Symlink(dest, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(crypt.PassphraseEnv, "wrong")
+	if _, err := crypt.Unlock(other); !errors.Is(err, crypt.ErrWrongPassphrase) {
+		t.Error("wrong passphrase accepted:", err)
+	}
+	if _, err := incremental.Latest(context.Background(), other); !errors.Is(err, crypt.ErrWrongPassphrase) {
+		t.Error("wrong passphrase not reported while looking for backups:", err)
+	}
+
+	_ = filepath.WalkDir(filepath.Join(dest, "chunks"), func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			data, _ := os.ReadFile(path)
+			data[len(data)-1] ^= 1
+			_ = os.WriteFile(path, data, 0644)
+		}
+		return nil
+	})
+	err = full.Restore(context.Background(), restored, folder)
+	if !errors.Is(err, utils.ErrCorrupted) {
+		t.Error("tampered backup restored:", err)
+	}
+	data, _ = os.ReadFile(filepath.Join(second, utils.Metadata))
+	data[len(data)-1] ^= 1
+	_ = os.WriteFile(filepath.Join(second, utils.Metadata), data, 0644)
+	if _, err := incremental.Latest(context.Background(), dest); !errors.Is(err, utils.ErrCorrupted) {
+		t.Error("tampered metadata skipped while looking for backups:", err)
+	}
+
+	crypt.Encrypt = false
+	_ = os.Remove(filepath.Join(dest, utils.Config))
+	_ = os.RemoveAll(filepath.Join(dest, utils.Keys))
+	stripped := filepath.Join(t.TempDir(), "stripped")
+	_ = os.Symlink(dest, stripped)
+	if _, err := crypt.Unlock(stripped); err == nil {
+		t.Error("backup folder without encryption config accepted, although passphrase is given")
+	}
+}
+
+func TestKeys(t *testing.T) {
+	utils.Yes = true
+	backup.UnsafeLinks = true // testdata links point outside of it
+	crypt.Encrypt = true
+	defer func() {
+		backup.UnsafeLinks = false
+		crypt.Encrypt = false
+	}()
+	t.Setenv(crypt.PassphraseEnv, "first")
+	dest := t.TempDir()
+	full.Backup(context.Background(), "testdata/src", dest)
+	slots, _ := crypt.Slots(dest)
+	if len(slots) != 1 {
+		t.Fatalf("expected 1 key, got %d", len(slots))
+	}
+	t.Setenv(crypt.NewPassphraseEnv, "second")
+	added, err := crypt.AddKey(dest, "colleague")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = crypt.RemoveKey(dest, slots[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = crypt.RemoveKey(dest, added.ID); err == nil {
+		t.Error("the only key removed")
+	}
+	if err = crypt.RemoveKey(dest, "../"+strings.TrimSuffix(utils.Config, ".json")); err == nil {
+		t.Error("invalid key id accepted")
+	}
+	if _, err := os.Stat(filepath.Join(dest, utils.Config)); err != nil {
+		t.Error("config removed:", err)
+	}
+	unlockAs := func(passphrase string) error { // unlocked keys are cached by path, so a new one is used every time
+		other := filepath.Join(t.TempDir(), "other")
+		_ = os.Symlink(dest, other)
+		t.Setenv(crypt.PassphraseEnv, passphrase)
+		_, err := crypt.Unlock(other)
+		return err
+	}
+	if unlockAs("first") == nil || unlockAs("second") != nil {
+		t.Error("keys not replaced")
+	}
+	t.Setenv(crypt.NewPassphraseEnv, "third")
+	other := filepath.Join(t.TempDir(), "other")
+	_ = os.Symlink(dest, other)
+	t.Setenv(crypt.PassphraseEnv, "second")
+	err = crypt.ChangePassphrase(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlockAs("second") == nil || unlockAs("third") != nil {
+		t.Error("passphrase not changed")
+	}
+	folder, _ := incremental.Latest(context.Background(), dest, "full")
+	restored := filepath.Join(t.TempDir(), "restored")
+	if err = full.Restore(context.Background(), restored, folder); err != nil || !checkSame("testdata/src", restored, t) {
+		t.Error("dirs different", err)
+	}
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			info, err := d.Info()
+			if err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+func countFiles(dir string) int {
+	res := 0
+	_ = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			res++
+		}
+		return nil
+	})
+	return res
+}
+
+func checkSame(src string, dest string, t *testing.T) bool {
 	info, err := os.Lstat(src)
 	if err != nil {
 		return false
 	}
 	if !info.IsDir() {
 		if info.Mode()&os.ModeSymlink != 0 {
-			info2, err := os.Lstat(dest)
+			link, err := os.Readlink(src)
 			if err != nil {
 				return false
 			}
-			return info2.Mode()&os.ModeSymlink != 0
+			link2, err := os.Readlink(dest)
+			return err == nil && link == link2
+		}
+		if !info.Mode().IsRegular() { // special files can not be read without blocking
+			info2, err := os.Lstat(dest)
+			return err == nil && info.Mode().Type() == info2.Mode().Type()
 		}
 		srcFile, err := os.Open(src)
 		if err != nil {
@@ -99,9 +1311,7 @@ func checkSame(src string, dest string, t *testing.T) bool {
 	}
 	for _, entry := range entries {
 		if _, err := os.Lstat(filepath.Join(src, entry.Name())); err != nil {
-			if entry.Name() != ".backup.json" {
-				return false
-			}
+			return false
 		}
 	}
 	return true
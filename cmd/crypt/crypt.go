@@ -0,0 +1,266 @@
+package crypt
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/SingularGamesStudio/backup/cmd/utils"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	// Encrypt makes new backup folders encrypted
+	Encrypt = false
+	// KeyFile is a file, contents of which are used instead of the passphrase
+	KeyFile = ""
+	// NewKeyFile is a file, contents of which are used instead of the new passphrase when managing keys
+	NewKeyFile = ""
+	// KeyName is the name of a new key slot
+	KeyName = "default"
+)
+
+const (
+	PassphraseEnv    = "BACKUP_PASSPHRASE"
+	NewPassphraseEnv = "BACKUP_NEW_PASSPHRASE"
+)
+
+var ErrWrongPassphrase = errors.New("wrong passphrase or key file")
+
+// keys caches unlocked keys of backup folders, nil for unencrypted ones
+var keys = map[string]*Key{}
+
+// Config describes encryption of a backup folder
+type Config struct {
+	Encryption string `json:"Encryption"`
+}
+
+// KDF describes how the key is derived from passphrase
+type KDF struct {
+	Name string `json:"Name"`
+	Salt []byte `json:"Salt"`
+	N    int    `json:"N"`
+	R    int    `json:"R"`
+	P    int    `json:"P"`
+}
+
+// Key encrypts and authenticates backup data
+type Key struct {
+	aead   cipher.AEAD
+	id     []byte
+	master []byte
+	slot   string // id of the key slot it was unlocked with
+}
+
+// Unlock returns key of the backup folder root, or nil if it is not encrypted.
+// New backup folders are initialized as encrypted if Encrypt is set
+func Unlock(root string) (*Key, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := keys[abs]; ok {
+		return key, nil
+	}
+	var key *Key
+	config, err := readConfig(root)
+	if errors.Is(err, os.ErrNotExist) {
+		switch {
+		case Encrypt:
+			key, err = initialize(root)
+		case keyGiven(): // encryption config might be deleted to replace backups with unauthenticated ones
+			err = fmt.Errorf("backup folder %s is not encrypted, but passphrase or key file is given", root)
+		default:
+			err = nil
+		}
+	} else if err == nil {
+		key, err = unlock(root, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys[abs] = key
+	return key, nil
+}
+
+// initialize creates encryption config and the first key slot for the new backup folder root
+func initialize(root string) (*Key, error) {
+	if _, err := os.Stat(filepath.Join(root, utils.Chunks)); err == nil {
+		return nil, fmt.Errorf("backup folder %s already contains unencrypted backups", root)
+	}
+	passphrase, err := passphrase("Enter backup passphrase", KeyFile, PassphraseEnv, true)
+	if err != nil {
+		return nil, err
+	}
+	master := make([]byte, 32)
+	_, err = rand.Read(master)
+	if err != nil {
+		return nil, err
+	}
+	key, err := newKey(master)
+	if err != nil {
+		return nil, err
+	}
+	key.slot, err = addSlot(root, master, KeyName, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	err = writeJson(filepath.Join(root, utils.Config), Config{Encryption: "xchacha20-poly1305"})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// unlock asks for passphrase and decrypts master key from one of the key slots
+func unlock(root string, config Config) (*Key, error) {
+	if config.Encryption != "xchacha20-poly1305" {
+		return nil, fmt.Errorf("unsupported encryption %s", config.Encryption)
+	}
+	slots, err := Slots(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(slots) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", filepath.Join(root, utils.Keys))
+	}
+	passphrase, err := passphrase("Enter backup passphrase", KeyFile, PassphraseEnv, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, slot := range slots {
+		wrapping, err := derive(passphrase, slot.KDF)
+		if err != nil {
+			return nil, err
+		}
+		master, err := wrapping.Open(slot.Key, "master key")
+		if err != nil {
+			continue
+		}
+		key, err := newKey(master)
+		if err != nil {
+			return nil, err
+		}
+		key.slot = slot.ID
+		return key, nil
+	}
+	return nil, ErrWrongPassphrase
+}
+
+// keyGiven checks whether passphrase or key file is given without asking for it
+func keyGiven() bool {
+	_, ok := os.LookupEnv(PassphraseEnv)
+	return KeyFile != "" || ok
+}
+
+// passphrase reads file, environment variable env or asks user for the passphrase
+func passphrase(prompt string, file string, env string, confirm bool) ([]byte, error) {
+	if file != "" {
+		return os.ReadFile(file)
+	}
+	if value, ok := os.LookupEnv(env); ok {
+		return []byte(value), nil
+	}
+	res, err := utils.AskPassword(prompt)
+	if err != nil {
+		return nil, err
+	}
+	if confirm {
+		again, err := utils.AskPassword("Repeat passphrase")
+		if err != nil {
+			return nil, err
+		}
+		if again != res {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	if res == "" {
+		return nil, errors.New("empty passphrase")
+	}
+	return []byte(res), nil
+}
+
+// derive derives key from passphrase
+func derive(passphrase []byte, kdf KDF) (*Key, error) {
+	key, err := scrypt.Key(passphrase, kdf.Salt, kdf.N, kdf.R, kdf.P, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{aead: aead}, nil
+}
+
+// newKey creates key from master key, with separate subkeys for encryption and chunk ids
+func newKey(master []byte) (*Key, error) {
+	aead, err := chacha20poly1305.NewX(subkey(master, "data"))
+	if err != nil {
+		return nil, err
+	}
+	return &Key{aead: aead, id: subkey(master, "id"), master: master}, nil
+}
+
+func subkey(master []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// readConfig reads encryption config of the backup folder root
+func readConfig(root string) (Config, error) {
+	data, err := os.ReadFile(filepath.Join(root, utils.Config))
+	if err != nil {
+		return Config{}, err
+	}
+	res := Config{}
+	err = json.Unmarshal(data, &res)
+	return res, err
+}
+
+// writeJson saves v to path, readable only by owner
+func writeJson(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// Seal encrypts and authenticates data, binding it to name
+func (k *Key) Seal(data []byte, name string) []byte {
+	nonce := make([]byte, k.aead.NonceSize(), k.aead.NonceSize()+len(data)+k.aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		panic(err)
+	}
+	return k.aead.Seal(nonce, nonce, data, []byte(name))
+}
+
+// Open decrypts data sealed with the same name, failing if it was modified
+func (k *Key) Open(data []byte, name string) ([]byte, error) {
+	if len(data) < k.aead.NonceSize() {
+		return nil, fmt.Errorf("%w: %s", utils.ErrCorrupted, name)
+	}
+	res, err := k.aead.Open(nil, data[:k.aead.NonceSize()], data[k.aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", utils.ErrCorrupted, name)
+	}
+	return res, nil
+}
+
+// ID returns keyed hash of data, so that chunk ids do not reveal contents
+func (k *Key) ID(data []byte) string {
+	mac := hmac.New(sha256.New, k.id)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,198 @@
+package crypt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/SingularGamesStudio/backup/cmd/utils"
+)
+
+// Slot stores master key of a backup folder, sealed with one of the passphrases
+type Slot struct {
+	ID      string    `json:"ID"`
+	Name    string    `json:"Name"`
+	Created time.Time `json:"Created"`
+	KDF     KDF       `json:"KDF"`
+	Key     []byte    `json:"Key"`
+}
+
+// Slots lists key slots of the backup folder root, oldest first
+func Slots(root string) ([]Slot, error) {
+	entries, err := os.ReadDir(filepath.Join(root, utils.Keys))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res []Slot
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(root, utils.Keys, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		slot := Slot{}
+		err = json.Unmarshal(data, &slot)
+		if err != nil {
+			return nil, fmt.Errorf("reading key %s: %w", entry.Name(), err)
+		}
+		res = append(res, slot)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Created.Before(res[j].Created)
+	})
+	return res, nil
+}
+
+// AddKey unlocks the backup folder root and adds a key slot for a new passphrase
+func AddKey(root string, name string) (Slot, error) {
+	key, err := unlockForManagement(root)
+	if err != nil {
+		return Slot{}, err
+	}
+	passphrase, err := passphrase("Enter new passphrase", NewKeyFile, NewPassphraseEnv, true)
+	if err != nil {
+		return Slot{}, err
+	}
+	id, err := addSlot(root, key.master, name, passphrase)
+	if err != nil {
+		return Slot{}, err
+	}
+	return readSlot(root, id)
+}
+
+// RemoveKey unlocks the backup folder root and removes key slot with given id, the last key can not be removed
+func RemoveKey(root string, id string) error {
+	err := validID(id)
+	if err != nil {
+		return err
+	}
+	_, err = unlockForManagement(root)
+	if err != nil {
+		return err
+	}
+	slots, err := Slots(root)
+	if err != nil {
+		return err
+	}
+	if len(slots) == 1 && slots[0].ID == id {
+		return errors.New("can not remove the only key of backup folder")
+	}
+	if _, err := readSlot(root, id); err != nil {
+		return err
+	}
+	return os.Remove(slotPath(root, id))
+}
+
+// ChangePassphrase unlocks the backup folder root and reseals the key slot used for it with a new passphrase
+func ChangePassphrase(root string) error {
+	key, err := unlockForManagement(root)
+	if err != nil {
+		return err
+	}
+	slot, err := readSlot(root, key.slot)
+	if err != nil {
+		return err
+	}
+	passphrase, err := passphrase("Enter new passphrase", NewKeyFile, NewPassphraseEnv, true)
+	if err != nil {
+		return err
+	}
+	slot.KDF, slot.Key, err = seal(key.master, passphrase)
+	if err != nil {
+		return err
+	}
+	return writeSlot(root, slot)
+}
+
+// unlockForManagement unlocks the backup folder root, which must be encrypted
+func unlockForManagement(root string) (*Key, error) {
+	if _, err := readConfig(root); errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("backup folder %s is not encrypted", root)
+	}
+	return Unlock(root)
+}
+
+// addSlot saves master key sealed with passphrase to a new key slot, and returns its id
+func addSlot(root string, master []byte, name string, passphrase []byte) (string, error) {
+	id := make([]byte, 4)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	slot := Slot{ID: hex.EncodeToString(id), Name: name, Created: time.Now()}
+	slot.KDF, slot.Key, err = seal(master, passphrase)
+	if err != nil {
+		return "", err
+	}
+	return slot.ID, writeSlot(root, slot)
+}
+
+// seal seals master key with the key derived from passphrase with a new salt
+func seal(master []byte, passphrase []byte) (KDF, []byte, error) {
+	kdf := KDF{Name: "scrypt", Salt: make([]byte, 16), N: 1 << 15, R: 8, P: 1}
+	_, err := rand.Read(kdf.Salt)
+	if err != nil {
+		return KDF{}, nil, err
+	}
+	wrapping, err := derive(passphrase, kdf)
+	if err != nil {
+		return KDF{}, nil, err
+	}
+	return kdf, wrapping.Seal(master, "master key"), nil
+}
+
+// validID checks that id is a key slot id, as generated by addSlot, so it can not name a file outside of the keys folder
+func validID(id string) error {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 8 {
+		return fmt.Errorf("invalid key id %q", id)
+	}
+	return nil
+}
+
+func slotPath(root string, id string) string {
+	return filepath.Join(root, utils.Keys, id+".json")
+}
+
+func readSlot(root string, id string) (Slot, error) {
+	if err := validID(id); err != nil {
+		return Slot{}, err
+	}
+	data, err := os.ReadFile(slotPath(root, id))
+	if errors.Is(err, os.ErrNotExist) {
+		return Slot{}, fmt.Errorf("key %s not found", id)
+	}
+	if err != nil {
+		return Slot{}, err
+	}
+	res := Slot{}
+	err = json.Unmarshal(data, &res)
+	if err == nil && res.ID != id {
+		return Slot{}, fmt.Errorf("%w: key %s has id %q", utils.ErrCorrupted, id, res.ID)
+	}
+	return res, err
+}
+
+// writeSlot saves key slot, replacing the old version atomically
+func writeSlot(root string, slot Slot) error {
+	err := os.MkdirAll(filepath.Join(root, utils.Keys), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmp := slotPath(root, slot.ID) + ".tmp"
+	err = writeJson(tmp, slot)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, slotPath(root, slot.ID))
+}
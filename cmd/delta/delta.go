@@ -0,0 +1,285 @@
+package delta
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Delta is a sequence of operations, each either copying a range of the base file or inserting literal data
+const (
+	opCopy    = 'C' // offset, length
+	opLiteral = 'L' // length, data
+)
+
+const maxLiteral = 64 << 10
+
+// ErrInvalid is returned by Patch for malformed deltas
+var ErrInvalid = errors.New("invalid delta")
+
+// blockSize returns size of blocks base file of given size is split into, like rsync does
+func blockSize(size int64) int {
+	return min(max(int(math.Sqrt(float64(size))), 2<<10), 64<<10)
+}
+
+// signature lists blocks of the base file by weak checksum, to find them in the new one
+type signature struct {
+	size   int
+	blocks map[uint32][]block
+}
+
+type block struct {
+	offset int64
+	strong [sha256.Size]byte
+}
+
+// sign splits base into blocks of given size and computes their checksums (the last short block is skipped)
+func sign(base io.Reader, size int) (signature, error) {
+	sig := signature{size: size, blocks: make(map[uint32][]block)}
+	buf := make([]byte, size)
+	r := bufio.NewReaderSize(base, 1<<20)
+	for offset := int64(0); ; offset += int64(size) {
+		_, err := io.ReadFull(r, buf)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return sig, nil
+		}
+		if err != nil {
+			return signature{}, err
+		}
+		weak := newRolling(buf).sum()
+		sig.blocks[weak] = append(sig.blocks[weak], block{offset: offset, strong: sha256.Sum256(buf)})
+	}
+}
+
+// find returns offset of the base block with contents data, or -1
+func (s signature) find(weak uint32, data []byte) int64 {
+	candidates := s.blocks[weak]
+	if len(candidates) == 0 {
+		return -1
+	}
+	strong := sha256.Sum256(data)
+	for _, b := range candidates {
+		if b.strong == strong {
+			return b.offset
+		}
+	}
+	return -1
+}
+
+// Diff writes delta turning base (of baseSize bytes) into target to out, and returns its size
+func Diff(base io.Reader, baseSize int64, target io.Reader, out io.Writer) (int64, error) {
+	sig, err := sign(base, blockSize(baseSize))
+	if err != nil {
+		return 0, err
+	}
+	w := newWriter(out)
+	r := bufio.NewReaderSize(target, 1<<20)
+	buf := make([]byte, 0, 4*sig.size)
+	// window is buf[start:start+sig.size]
+	start := 0
+	fill := func() error { // reads a whole new window after the current one
+		buf = append(buf[:0], buf[start:]...)
+		start = 0
+		n, err := io.ReadFull(r, buf[len(buf):len(buf)+sig.size])
+		buf = buf[:len(buf)+n]
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return io.EOF
+		}
+		return err
+	}
+	err = fill()
+	for err == nil {
+		window := newRolling(buf[start : start+sig.size])
+		for {
+			if offset := sig.find(window.sum(), buf[start:start+sig.size]); offset >= 0 {
+				if err = w.copy(offset, int64(sig.size)); err != nil {
+					return 0, err
+				}
+				start += sig.size
+				break
+			}
+			c, readErr := r.ReadByte()
+			if errors.Is(readErr, io.EOF) {
+				err = io.EOF
+				break
+			}
+			if readErr != nil {
+				return 0, readErr
+			}
+			if err = w.literal(buf[start : start+1]); err != nil {
+				return 0, err
+			}
+			window.roll(buf[start], c)
+			buf = append(buf, c)
+			start++
+			if start >= 3*sig.size { // keep buffer from growing
+				buf = append(buf[:0], buf[start:]...)
+				start = 0
+			}
+		}
+		if err == nil {
+			err = fill()
+		}
+	}
+	if !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	if err = w.literal(buf[start:]); err != nil { // tail shorter than a block
+		return 0, err
+	}
+	return w.close()
+}
+
+// Patch applies delta to base and writes the result to out
+func Patch(base io.ReaderAt, delta io.Reader, out io.Writer) error {
+	r := bufio.NewReader(delta)
+	for {
+		op, err := r.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch op {
+		case opCopy:
+			offset, err := binary.ReadUvarint(r)
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrInvalid, err)
+			}
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrInvalid, err)
+			}
+			_, err = io.Copy(out, io.NewSectionReader(base, int64(offset), int64(length)))
+			if err != nil {
+				return err
+			}
+		case opLiteral:
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrInvalid, err)
+			}
+			_, err = io.CopyN(out, r, int64(length))
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("%w: %w", ErrInvalid, io.ErrUnexpectedEOF)
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: unknown operation %q", ErrInvalid, op)
+		}
+	}
+}
+
+// writer encodes delta operations, merging adjacent ones
+type writer struct {
+	out       *bufio.Writer
+	size      int64
+	copyStart int64
+	copyLen   int64
+	pending   []byte
+}
+
+func newWriter(out io.Writer) *writer {
+	return &writer{out: bufio.NewWriter(out)}
+}
+
+func (w *writer) copy(offset int64, length int64) error {
+	if err := w.flushLiteral(); err != nil {
+		return err
+	}
+	if w.copyLen > 0 && w.copyStart+w.copyLen == offset {
+		w.copyLen += length
+		return nil
+	}
+	if err := w.flushCopy(); err != nil {
+		return err
+	}
+	w.copyStart, w.copyLen = offset, length
+	return nil
+}
+
+func (w *writer) literal(data []byte) error {
+	if err := w.flushCopy(); err != nil {
+		return err
+	}
+	w.pending = append(w.pending, data...)
+	if len(w.pending) >= maxLiteral {
+		return w.flushLiteral()
+	}
+	return nil
+}
+
+func (w *writer) flushCopy() error {
+	if w.copyLen == 0 {
+		return nil
+	}
+	err := w.op(opCopy, uint64(w.copyStart), uint64(w.copyLen))
+	w.copyLen = 0
+	return err
+}
+
+func (w *writer) flushLiteral() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	err := w.op(opLiteral, uint64(len(w.pending)))
+	if err == nil {
+		_, err = w.out.Write(w.pending)
+		w.size += int64(len(w.pending))
+	}
+	w.pending = w.pending[:0]
+	return err
+}
+
+func (w *writer) op(op byte, args ...uint64) error {
+	buf := binary.AppendUvarint([]byte{op}, args[0])
+	for _, arg := range args[1:] {
+		buf = binary.AppendUvarint(buf, arg)
+	}
+	w.size += int64(len(buf))
+	_, err := w.out.Write(buf)
+	return err
+}
+
+// close flushes pending operations and returns delta size
+func (w *writer) close() (int64, error) {
+	if err := w.flushCopy(); err != nil {
+		return 0, err
+	}
+	if err := w.flushLiteral(); err != nil {
+		return 0, err
+	}
+	return w.size, w.out.Flush()
+}
+
+// rolling is the rsync weak checksum of a window, which can be moved by one byte in O(1)
+type rolling struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRolling(data []byte) rolling {
+	r := rolling{n: uint32(len(data))}
+	for i, c := range data {
+		r.a += uint32(c)
+		r.b += uint32(len(data)-i) * uint32(c)
+	}
+	return r
+}
+
+// roll removes byte out from the start of the window, and appends byte in to its end
+func (r *rolling) roll(out byte, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r rolling) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
@@ -5,8 +5,8 @@ import (
 	"fmt"
 
 	"github.com/SingularGamesStudio/backup/cmd/backup"
+	"github.com/SingularGamesStudio/backup/cmd/chunk"
 	"github.com/SingularGamesStudio/backup/cmd/utils"
-	"github.com/SingularGamesStudio/backup/cmd/utils/file"
 )
 
 func Backup(ctx context.Context, dir string, targetDir string) {
@@ -15,29 +15,41 @@ func Backup(ctx context.Context, dir string, targetDir string) {
 		utils.PrintError("setting up backup folder", err)
 		return
 	}
-	found, err := backup.CheckJson(dir)
-	if err == nil && found {
-		if !utils.AskForConfirmation(fmt.Sprintf("%s found in source directory, it will be deleted in backup. Proceed?", utils.Metadata)) {
-			err = utils.ErrAborted
-		}
+	store, err := chunk.Open(targetDir)
+	if err != nil {
+		utils.PrintError("opening chunk store", err)
+		backup.TryAbort(backupDir)
+		return
+	}
+	index, err := backup.LoadIndex(targetDir, dir)
+	if err != nil { // index only speeds things up, so everything is just read again
+		utils.PrintError("loading file index", err)
 	}
+	fmt.Println("Saving data...")
+	manifest := backup.Manifest{Xattrs: backup.Xattrs}
+	err = backup.Snapshot(ctx, store, index, dir, "", &manifest)
 	if err != nil {
-		utils.PrintError(fmt.Sprintf("checking for %s in source", utils.Metadata), err)
+		utils.PrintError("saving files", err)
+		backup.TryAbort(backupDir)
 		return
 	}
-	fmt.Println("Copying data...")
-	err = file.CopyFolder(ctx, dir, backupDir)
+	manifest.PrintMountPoints()
+	err = backup.SaveManifest(backupDir, manifest)
 	if err != nil {
-		utils.PrintError("copying files", err)
+		utils.PrintError("saving backup manifest", err)
 		backup.TryAbort(backupDir)
 		return
 	}
 	fmt.Println("Saving backup metadata...")
-	err = backup.SaveInfo(backupDir, backup.Info{Type: "full"})
+	err = backup.SaveInfo(backupDir, backup.Info{Type: "full", Compression: chunk.Compression})
 	if err != nil {
 		utils.PrintError("saving backup metadata", err)
 		backup.TryAbort(backupDir)
 		return
 	}
+	err = index.Save()
+	if err != nil {
+		utils.PrintError("saving file index", err)
+	}
 	fmt.Println("Backup successful")
 }
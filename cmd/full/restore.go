@@ -6,6 +6,8 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/SingularGamesStudio/backup/cmd/backup"
+	"github.com/SingularGamesStudio/backup/cmd/chunk"
 	"github.com/SingularGamesStudio/backup/cmd/utils"
 	"github.com/SingularGamesStudio/backup/cmd/utils/file"
 )
@@ -29,17 +31,34 @@ func Restore(ctx context.Context, dir string, backupDir string) error {
 			return err
 		}
 	}
-	fmt.Println("Copying data...")
-	err = file.CopyFolder(ctx, backupDir, dir)
+	fmt.Println("Reading backup manifest...")
+	manifest, err := backup.GetManifest(backupDir)
 	if err != nil {
-		utils.PrintError("copying files", err)
+		utils.PrintError("reading backup manifest", err)
 		return err
 	}
-	fmt.Println("Deleting backup metadata...")
-	err = os.Remove(filepath.Join(dir, utils.Metadata))
+	store, err := chunk.Open(filepath.Dir(backupDir))
 	if err != nil {
-		utils.PrintError("Deleting backup metadata", err)
-		fmt.Printf("Restore successful, but file %s failed to be deleted, consider deleting it manually\n", utils.Metadata)
+		utils.PrintError("opening chunk store", err)
+		return err
+	}
+	fmt.Println("Restoring data...")
+	for _, entry := range manifest.Entries {
+		err = backup.RestoreEntry(ctx, store, entry, dir)
+		if err != nil {
+			utils.PrintError(fmt.Sprintf("restoring %s", entry.Path), err)
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			utils.PrintError("restoring files", ctx.Err())
+			return ctx.Err()
+		default:
+		}
+	}
+	err = backup.RestoreDirTimes(ctx, manifest, dir)
+	if err != nil {
+		utils.PrintError("restoring directory times", err)
 		return err
 	}
 	fmt.Println("Restore successful")
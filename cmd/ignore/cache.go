@@ -0,0 +1,30 @@
+package ignore
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// CacheTag is the name of the file marking cache directories, see https://bford.info/cachedir/
+const CacheTag = "CACHEDIR.TAG"
+
+// cacheSignature is what CacheTag file has to start with
+const cacheSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+
+// isCache checks whether directory at path is tagged as a cache
+func isCache(path string) (bool, error) {
+	f, err := os.Open(filepath.Join(path, CacheTag))
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	buf := make([]byte, len(cacheSignature))
+	_, err = io.ReadFull(f, buf)
+	return err == nil && string(buf) == cacheSignature, nil // shorter files (or directories with this name) are not tags
+}
@@ -0,0 +1,190 @@
+package ignore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// Rules decide which paths inside a folder are excluded, using gitignore-style patterns, given for the whole folder
+// or read from ignore files inside it. Nil Rules exclude nothing
+type Rules struct {
+	dir      string
+	patterns []pattern // given for the whole folder, they take precedence over ignore files
+	names    []string  // names of ignore files, later ones override earlier ones in the same directory
+	files    map[string][]pattern
+
+	Caches bool // also exclude directories tagged with CacheTag file
+}
+
+// pattern is a single line of an ignore file
+type pattern struct {
+	base     string   // slash-separated directory of ignore file, relative to the folder
+	segments []string // slash-separated parts
+	negate   bool     // matching paths are included back
+	dirOnly  bool     // only matches directories
+	anchored bool     // matched against the path relative to base, otherwise against the name only
+}
+
+// New creates rules for dir from patterns (matched relative to dir, with the last matching one winning, like in a single ignore file)
+// and ignore files with given names in dir and its subdirectories
+func New(dir string, patterns []string, names ...string) (*Rules, error) {
+	r := &Rules{dir: dir, names: names, files: make(map[string][]pattern)}
+	for _, line := range patterns {
+		p, ok, err := parse(line, "")
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			r.patterns = append(r.patterns, p)
+		}
+	}
+	return r, nil
+}
+
+// Valid checks whether line is a valid pattern
+func Valid(line string) error {
+	_, _, err := parse(line, "")
+	return err
+}
+
+// parse parses line of ignore file in directory base, returns false for empty lines and comments
+func parse(line string, base string) (pattern, bool, error) {
+	line = strings.TrimSuffix(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = strings.TrimSuffix(line, " ")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return pattern{}, false, nil
+	}
+	p := pattern{base: base}
+	if strings.HasPrefix(line, "!") {
+		p.negate, line = true, line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly, line = true, strings.TrimSuffix(line, "/")
+	}
+	p.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return pattern{}, false, nil
+	}
+	p.segments = strings.Split(line, "/")
+	for _, segment := range p.segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return pattern{}, false, fmt.Errorf("invalid pattern %q: %w", line, err)
+		}
+	}
+	return p, true, nil
+}
+
+// Match checks whether rel (relative to the folder) is excluded. Its parent directories must be checked first:
+// like in git, nothing inside an excluded directory can be included back
+func (r *Rules) Match(rel string, isDir bool) (bool, error) {
+	if r == nil {
+		return false, nil
+	}
+	rel = filepath.ToSlash(rel)
+	var patterns []pattern
+	for dir := path.Dir(rel); ; dir = path.Dir(dir) { // outer ignore files go first, so that inner ones override them
+		filePatterns, err := r.load(dir)
+		if err != nil {
+			return false, err
+		}
+		patterns = slices.Concat(filePatterns, patterns)
+		if dir == "." {
+			break
+		}
+	}
+	excluded := false
+	for _, p := range append(patterns, r.patterns...) {
+		if p.match(rel, isDir) {
+			excluded = !p.negate
+		}
+	}
+	if !excluded && isDir && r.Caches {
+		return isCache(filepath.Join(r.dir, filepath.FromSlash(rel)))
+	}
+	return excluded, nil
+}
+
+// load returns patterns of ignore files in slash-separated directory dir, reading them on first use
+func (r *Rules) load(dir string) ([]pattern, error) {
+	if patterns, ok := r.files[dir]; ok {
+		return patterns, nil
+	}
+	base := dir
+	if base == "." {
+		base = ""
+	}
+	var patterns []pattern
+	for _, name := range r.names {
+		data, err := os.ReadFile(filepath.Join(r.dir, filepath.FromSlash(base), name))
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) { // directory might be deleted or replaced with a file since the base backup
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for line := 1; scanner.Scan(); line++ {
+			p, ok, err := parse(scanner.Text(), base)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path.Join(base, name), line, err)
+			}
+			if ok {
+				patterns = append(patterns, p)
+			}
+		}
+	}
+	r.files[dir] = patterns
+	return patterns, nil
+}
+
+// match checks whether slash-separated rel (relative to the folder) matches pattern
+func (p pattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.base != "" {
+		if !strings.HasPrefix(rel, p.base+"/") {
+			return false
+		}
+		rel = rel[len(p.base)+1:]
+	}
+	if !p.anchored {
+		return matchSegments(p.segments, []string{path.Base(rel)})
+	}
+	return matchSegments(p.segments, strings.Split(rel, "/"))
+}
+
+// matchSegments matches path parts against pattern parts, where ** matches any number of parts
+// (at least one, if it is the last part, so that dir/** matches everything inside dir, but not dir itself)
+func matchSegments(segments []string, parts []string) bool {
+	if len(segments) == 0 {
+		return len(parts) == 0
+	}
+	if segments[0] == "**" {
+		if len(segments) == 1 {
+			return len(parts) > 0
+		}
+		for i := range len(parts) + 1 {
+			if matchSegments(segments[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	ok, _ := path.Match(segments[0], parts[0])
+	return ok && matchSegments(segments[1:], parts[1:])
+}
@@ -3,92 +3,100 @@ package incremental
 import (
 	"context"
 	"fmt"
-	"os"
 	"path/filepath"
 
 	"github.com/SingularGamesStudio/backup/cmd/backup"
+	"github.com/SingularGamesStudio/backup/cmd/chunk"
 	"github.com/SingularGamesStudio/backup/cmd/utils"
 )
 
+// Backup saves changes since the latest backup of any type
 func Backup(ctx context.Context, dir string, targetDir string) {
+	saveDiff(ctx, dir, targetDir, "incremental")
+}
+
+// Differential saves changes since the latest full backup
+func Differential(ctx context.Context, dir string, targetDir string) {
+	saveDiff(ctx, dir, targetDir, "differential")
+}
+
+// saveDiff saves backup of type backupType, containing changes since its parent
+func saveDiff(ctx context.Context, dir string, targetDir string, backupType string) {
 	backupDir, err := backup.Setup(ctx, targetDir)
 	if err != nil {
 		utils.PrintError("setting up backup folder", err)
 		return
 	}
-	foundWrongExt, err := checkExts(ctx, dir)
+	var parent string
+	if backupType == "differential" {
+		fmt.Println("Looking for latest full backup...")
+		parent, err = Latest(ctx, targetDir, "full")
+	} else {
+		fmt.Println("Looking for latest backup...")
+		parent, err = Latest(ctx, targetDir)
+	}
 	if err != nil {
-		utils.PrintError("traversing target folder", err)
+		utils.PrintError("looking for parent backup", err)
 		return
 	}
-	if foundWrongExt {
-		fmt.Printf("Files with extension %s found in %s, they are not supported for incremental backup. Aborting.\n", utils.DeletedExt, dir)
+	chain, err := backup.Chain(parent)
+	if err != nil {
+		utils.PrintError("reading backup chain", err)
+		backup.TryAbort(backupDir)
 		return
 	}
-	found, err := backup.CheckJson(dir)
-	if err == nil && found {
-		if !utils.AskForConfirmation(fmt.Sprintf("%s found in source directory, it will be deleted in backup. Proceed?", utils.Metadata)) {
-			err = utils.ErrAborted
-		}
-	}
+	manifest, err := backup.Resolve(parent)
 	if err != nil {
-		utils.PrintError(fmt.Sprintf("checking for %s in source", utils.Metadata), err)
+		utils.PrintError("reading backup manifests", err)
+		backup.TryAbort(backupDir)
 		return
 	}
-	fmt.Println("Looking for latest full backup...")
-	base, err := Latest(ctx, targetDir, true)
+	entries := make(map[string]backup.Entry, len(manifest.Entries))
+	for _, entry := range manifest.Entries {
+		entries[entry.Path] = entry
+	}
+	store, err := chunk.Open(targetDir)
 	if err != nil {
-		utils.PrintError("looking for latest full backup", err)
+		utils.PrintError("opening chunk store", err)
+		backup.TryAbort(backupDir)
 		return
 	}
-	fmt.Println("Saving diff between full backup and current state...")
-	err = saveChanged(ctx, base, dir, backupDir)
+	index, err := backup.LoadIndex(targetDir, dir)
+	if err != nil { // index only speeds things up, so everything is just read again
+		utils.PrintError("loading file index", err)
+	}
+	fmt.Printf("Saving diff between %s and current state...\n", filepath.Base(parent))
+	changes := backup.Manifest{Xattrs: backup.Xattrs}
+	err = rememberUnchanged(ctx, manifest.Entries, dir, &changes)
+	if err == nil {
+		err = saveChanged(ctx, store, index, newMoves(entries, dir), entries, dir, "", &changes)
+	}
 	if err != nil {
 		utils.PrintError("calculating and saving diff", err)
 		backup.TryAbort(backupDir)
 		return
 	}
+	changes.PrintMountPoints()
 	fmt.Println("Saving info about deleted files...")
-	err = saveDeleted(ctx, base, dir, backupDir, true)
+	err = saveDeleted(ctx, manifest.Entries, dir, &changes)
+	if err == nil {
+		err = backup.SaveManifest(backupDir, changes)
+	}
 	if err != nil {
 		utils.PrintError("calculating and saving diff (deleted files)", err)
 		backup.TryAbort(backupDir)
 		return
 	}
 	fmt.Println("Saving backup metadata...")
-	err = backup.SaveInfo(backupDir, backup.Info{Type: "incremental", Base: filepath.Base(base)})
+	err = backup.SaveInfo(backupDir, backup.Info{Type: backupType, Base: filepath.Base(chain[0]), Parent: filepath.Base(parent), Compression: chunk.Compression})
 	if err != nil {
 		utils.PrintError("saving backup metadata", err)
 		backup.TryAbort(backupDir)
 		return
 	}
-	fmt.Println("Backup successful")
-}
-
-// checkExts checks if there are files with extension .deleted
-func checkExts(ctx context.Context, path string) (bool, error) {
-	entries, err := os.ReadDir(path)
+	err = index.Save()
 	if err != nil {
-		return false, err
+		utils.PrintError("saving file index", err)
 	}
-	for _, entry := range entries {
-		if filepath.Ext(entry.Name()) == utils.DeletedExt {
-			return true, nil
-		}
-		if entry.IsDir() {
-			found, err := checkExts(ctx, filepath.Join(path, entry.Name()))
-			if err != nil {
-				return false, err
-			}
-			if found {
-				return true, nil
-			}
-		}
-		select {
-		case <-ctx.Done():
-			return false, ctx.Err()
-		default:
-		}
-	}
-	return false, nil
+	fmt.Println("Backup successful")
 }
@@ -0,0 +1,90 @@
+package incremental
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/SingularGamesStudio/backup/cmd/backup"
+	"github.com/SingularGamesStudio/backup/cmd/chunk"
+	"github.com/SingularGamesStudio/backup/cmd/utils"
+)
+
+// Consolidate merges the latest backup chain in targetDir into a new full backup, without reading the source
+func Consolidate(ctx context.Context, targetDir string) {
+	fmt.Println("Looking for latest backup...")
+	latest, err := Latest(ctx, targetDir)
+	if err != nil {
+		utils.PrintError("looking for latest backup", err)
+		return
+	}
+	info, err := backup.GetJson(latest)
+	if err != nil {
+		utils.PrintError("reading backup metadata", err)
+		return
+	}
+	if info.Type == "full" {
+		fmt.Printf("Latest backup %s is already full, nothing to consolidate\n", filepath.Base(latest))
+		return
+	}
+	fmt.Printf("Merging backup chain of %s...\n", filepath.Base(latest))
+	manifest, err := backup.Resolve(latest)
+	if err != nil {
+		utils.PrintError("reading backup manifests", err)
+		return
+	}
+	store, err := chunk.Open(targetDir)
+	if err != nil {
+		utils.PrintError("opening chunk store", err)
+		return
+	}
+	fmt.Println("Checking that all data is present...")
+	err = checkChunks(ctx, store, manifest)
+	if err != nil {
+		utils.PrintError("checking chunks", err)
+		return
+	}
+	backupDir, err := backup.Setup(ctx, targetDir)
+	if err != nil {
+		utils.PrintError("setting up backup folder", err)
+		return
+	}
+	fmt.Println("Saving backup manifest...")
+	err = backup.SaveManifest(backupDir, manifest)
+	if err != nil {
+		utils.PrintError("saving backup manifest", err)
+		backup.TryAbort(backupDir)
+		return
+	}
+	fmt.Println("Saving backup metadata...")
+	err = backup.SaveInfo(backupDir, backup.Info{Type: "full", Source: filepath.Base(latest)})
+	if err != nil {
+		utils.PrintError("saving backup metadata", err)
+		backup.TryAbort(backupDir)
+		return
+	}
+	fmt.Println("Consolidation successful")
+}
+
+// checkChunks checks that all chunks (and deltas) of manifest are in store
+func checkChunks(ctx context.Context, store *chunk.Store, manifest backup.Manifest) error {
+	for _, entry := range manifest.Entries {
+		for _, ids := range append([][]string{entry.Chunks}, entry.Delta...) {
+			for _, id := range ids {
+				found, err := store.Has(id)
+				if err != nil {
+					return err
+				}
+				if !found {
+					return fmt.Errorf("%w: chunk %s of %s is missing", utils.ErrCorrupted, id, entry.Path)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+	}
+	return nil
+}
@@ -1,20 +1,31 @@
 package incremental
 
 import (
+	"bytes"
 	"context"
 	"errors"
-	"io/fs"
+	"maps"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"time"
 
 	"github.com/SingularGamesStudio/backup/cmd/backup"
+	"github.com/SingularGamesStudio/backup/cmd/chunk"
+	"github.com/SingularGamesStudio/backup/cmd/crypt"
 	"github.com/SingularGamesStudio/backup/cmd/utils"
 	"github.com/SingularGamesStudio/backup/cmd/utils/file"
 )
 
-// Latest gets last <full> backup in dir
-func Latest(ctx context.Context, dir string, full bool) (string, error) {
+// Checksum makes change detection compare file contents by hash, with mtime and size only used to skip unchanged files
+var Checksum = false
+
+// Delta makes modified files be saved as binary deltas against their base backup versions, when that is much smaller
+var Delta = false
+
+// Latest gets last backup in dir of one of given types (of any type, if none are given)
+func Latest(ctx context.Context, dir string, types ...string) (string, error) {
 	entries, err := os.ReadDir(dir)
 	if err != nil {
 		return "", err
@@ -34,11 +45,17 @@ func Latest(ctx context.Context, dir string, full bool) (string, error) {
 			if err != nil || !exists {
 				continue
 			}
+			if _, err := crypt.Unlock(dir); err != nil { // otherwise no backup could be read, and passphrase would be asked for each
+				return "", err
+			}
 			info, err := backup.GetJson(filepath.Join(dir, entry.Name()))
+			if errors.Is(err, utils.ErrCorrupted) {
+				return "", err
+			}
 			if err != nil {
 				continue
 			}
-			if (info.Type == "full" && full) || (info.Type == "incremental" && !full) {
+			if len(types) == 0 || slices.Contains(types, info.Type) {
 				latest = when
 				res = filepath.Join(dir, entry.Name())
 			}
@@ -55,48 +72,77 @@ func Latest(ctx context.Context, dir string, full bool) (string, error) {
 	return res, nil
 }
 
-// saveChanged saves files that changed in new, compared with old (except deleted ones)
-func saveChanged(ctx context.Context, old string, new string, dest string) error {
-	entries, err := os.ReadDir(new)
+// saveChanged saves files in dir/rel that changed compared with base backup entries (except deleted ones)
+// to store, and appends their entries to manifest. Index is updated with files that were read
+func saveChanged(ctx context.Context, store *chunk.Store, index *backup.Index, moves *moves, base map[string]backup.Entry, dir string, rel string, manifest *backup.Manifest) error {
+	entries, err := os.ReadDir(filepath.Join(dir, rel))
 	if err != nil {
 		return err
 	}
 	for _, entry := range entries {
-		change, err := changed(entry, old, new)
+		child := filepath.Join(rel, entry.Name())
+		info, ok, err := backup.WalkInfo(dir, child, entry)
+		excluded := false
+		if err == nil && ok {
+			excluded, err = manifest.Excluded(dir, child, info.IsDir())
+		}
 		if err != nil {
 			return err
 		}
-		if !entry.IsDir() {
-			if change != "false" { // file changed
-				err = file.MkdirAll(new, dest)
-				if err != nil {
-					return err
-				}
-				err = file.CopyFile(filepath.Join(new, entry.Name()), filepath.Join(dest, entry.Name()))
-				if err != nil {
-					return err
-				}
-			}
+		if !ok || excluded {
 			continue
 		}
-		if change != "false" { // directory changed
-			err = file.MkdirAll(filepath.Join(new, entry.Name()), filepath.Join(dest, entry.Name()))
-			if err != nil {
-				return err
-			}
+		change, err := changed(ctx, index, base, dir, child, info)
+		if err != nil {
+			return err
 		}
-		if change == "new" { // directory created
-			err = file.CopyFolder(ctx, filepath.Join(new, entry.Name()), filepath.Join(dest, entry.Name()))
-			if err != nil {
-				return err
+		saved, linked, err := manifest.Linked(dir, child, info)
+		if err != nil {
+			return err
+		}
+		if linked && (change == "" || change == backup.MetadataChanged) {
+			// unchanged file is only saved again, if it became a hard link to another one since the base backup
+			if saved.LinkTo == base[filepath.ToSlash(child)].LinkTo {
+				linked = false
+			} else {
+				change = backup.Modified
 			}
-			continue
 		}
-		// directory contents might be changed
-		err = saveChanged(ctx, filepath.Join(old, entry.Name()), filepath.Join(new, entry.Name()), filepath.Join(dest, entry.Name()))
+		saved.Change = change
+		switch { // only chunks not present in store yet are saved
+		case change == "" || linked:
+		case change == backup.Added:
+			saved, err = saveAdded(ctx, store, index, moves, dir, child, info)
+		case change == backup.MetadataChanged:
+			saved, err = backup.NewEntry(dir, child)
+			saved.Change = change
+		case change == backup.Modified:
+			saved, err = saveModified(ctx, store, index, base[filepath.ToSlash(child)], dir, child, info)
+			saved.Change = change
+		default:
+			saved, err = backup.SaveEntry(ctx, store, index, dir, child)
+			saved.Change = change
+		}
 		if err != nil {
 			return err
 		}
+		if change != "" {
+			manifest.Entries = append(manifest.Entries, saved)
+		}
+		if change == "" || change == backup.MetadataChanged { // other hard links to it are saved as links
+			manifest.Remember(base[filepath.ToSlash(child)], info)
+		} else if !linked {
+			manifest.Remember(saved, info)
+		}
+		if info.IsDir() { // contents of added directories are all added too, but might be moved from elsewhere
+			descend, err := manifest.Descend(dir, child, info)
+			if err == nil && descend {
+				err = saveChanged(ctx, store, index, moves, base, dir, child, manifest)
+			}
+			if err != nil {
+				return err
+			}
+		}
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
@@ -106,37 +152,84 @@ func saveChanged(ctx context.Context, old string, new string, dest string) error
 	return nil
 }
 
-// saveDeleted saves files that were deleted in new, compared with old
-func saveDeleted(ctx context.Context, old string, new string, dest string, root bool) error {
-	entries, err := os.ReadDir(old)
-	if err != nil {
-		return err
+// rememberUnchanged remembers files from base backup entries, that still have the same type, mtime and size in dir,
+// so that new hard links to them are saved as links, wherever they are found during the walk
+func rememberUnchanged(ctx context.Context, base []backup.Entry, dir string, manifest *backup.Manifest) error {
+	for _, targets := range []bool{true, false} { // files the others were linked to go first, to keep the same link targets
+		for _, entry := range base {
+			if !entry.Mode.IsRegular() || (entry.LinkTo == "") != targets {
+				continue
+			}
+			info, err := backup.Lstat(filepath.Join(dir, filepath.FromSlash(entry.Path)))
+			if err != nil { // deleted, or reported by the walk
+				continue
+			}
+			if info.Mode().Type() == entry.Mode.Type() && info.ModTime().Equal(entry.ModTime) && info.Size() == entry.Size {
+				manifest.Remember(entry, info)
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+		}
 	}
-	for _, entry := range entries {
-		if root && entry.Name() == utils.Metadata { //.backup.json is considered deleted, but it is not
+	return nil
+}
+
+// saveModified saves modified file dir/rel, as a binary delta against its base backup entry old if Delta is set
+func saveModified(ctx context.Context, store *chunk.Store, index *backup.Index, old backup.Entry, dir string, rel string, info os.FileInfo) (backup.Entry, error) {
+	if Delta && info.Mode().IsRegular() && len(old.Chunks) > 0 {
+		if _, ok := index.Lookup(rel, info); !ok { // otherwise the contents are already in store
+			entry, ok, err := backup.SaveDelta(ctx, store, index, old, dir, rel)
+			if err != nil || ok {
+				return entry, err
+			}
+		}
+	}
+	return backup.SaveEntry(ctx, store, index, dir, rel)
+}
+
+// saveDeleted appends entries from base backup, that were deleted in dir (and are not excluded from backup now), to manifest
+func saveDeleted(ctx context.Context, base []backup.Entry, dir string, manifest *backup.Manifest) error {
+	gone := make(map[string]bool)
+	excluded := make(map[string]bool) // excluded files are kept as they were in the base backup, instead of being deleted
+	for _, entry := range base {
+		if excluded[path.Dir(entry.Path)] {
+			excluded[entry.Path] = true
 			continue
 		}
-		change, err := changed(entry, new, old) //reversed argument order, so "new" would mean that file was deleted
+		isExcluded, err := manifest.Excluded(dir, entry.Path, entry.Mode.IsDir())
 		if err != nil {
 			return err
 		}
-		if change == "new" {
-			err = file.MkdirAll(old, dest)
-			if err != nil {
-				return err
-			}
-			file, err := os.Create(filepath.Join(dest, entry.Name()+utils.DeletedExt))
-			if err != nil {
-				return err
-			}
-			file.Close()
+		if isExcluded {
+			excluded[entry.Path] = true
 			continue
 		}
-		if entry.IsDir() {
-			err = saveDeleted(ctx, filepath.Join(old, entry.Name()), filepath.Join(new, entry.Name()), filepath.Join(dest, entry.Name()), false)
-			if err != nil {
-				return err
-			}
+		if gone[path.Dir(entry.Path)] { // removed together with parent directory
+			gone[entry.Path] = true
+			continue
+		}
+		info, err := backup.Lstat(filepath.Join(dir, filepath.FromSlash(entry.Path)))
+		if errors.Is(err, os.ErrNotExist) {
+			gone[entry.Path] = true
+			manifest.Entries = append(manifest.Entries, backup.Entry{
+				Path:    entry.Path,
+				Mode:    entry.Mode,
+				Uid:     entry.Uid,
+				Gid:     entry.Gid,
+				ModTime: entry.ModTime,
+				Size:    entry.Size,
+				Change:  backup.Deleted,
+			})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode().Type() != entry.Mode.Type() { // old contents are replaced together with the type
+			gone[entry.Path] = true
 		}
 		select {
 		case <-ctx.Done():
@@ -147,24 +240,104 @@ func saveDeleted(ctx context.Context, old string, new string, dest string, root
 	return nil
 }
 
-// changed returns how entry was changed in new, compared to old ("new" - created, "true" - modified, "false" - no change)
-func changed(entry fs.DirEntry, old string, new string) (string, error) {
-	oldStat, err := os.Lstat(filepath.Join(old, entry.Name()))
-	if errors.Is(err, os.ErrNotExist) {
-		return "new", nil
+// changed returns how dir/rel (described by stat) was changed, compared to base backup entries ("" if it was not)
+func changed(ctx context.Context, index *backup.Index, base map[string]backup.Entry, dir string, rel string, stat os.FileInfo) (string, error) {
+	old, ok := base[filepath.ToSlash(rel)]
+	if !ok {
+		return backup.Added, nil
 	}
-	if err != nil {
-		return "", err
+	if stat.Mode().Type() != old.Mode.Type() {
+		return backup.TypeChanged, nil
 	}
-	newStat, err := os.Lstat(filepath.Join(new, entry.Name()))
-	if err != nil {
+	if stat.Mode()&os.ModeDevice != 0 { // device node can be recreated pointing to another device
+		major, minor := file.Device(stat)
+		if major != old.Major || minor != old.Minor {
+			return backup.Modified, nil
+		}
+	}
+	if old.LinkTo != "" { // hard link might be broken (e.g. one of the files replaced by an editor)
+		target, err := backup.Lstat(filepath.Join(dir, filepath.FromSlash(old.LinkTo)))
+		if err != nil || !os.SameFile(target, stat) {
+			return backup.Modified, nil
+		}
+	}
+	change := ""
+	switch {
+	case Checksum:
+		var err error
+		change, err = changedContents(ctx, index, old, dir, rel, stat)
+		if err != nil {
+			return "", err
+		}
+	case stat.IsDir():
+		if stat.ModTime().After(old.ModTime) {
+			change = backup.Modified
+		}
+	case !stat.ModTime().Equal(old.ModTime) || stat.Size() != old.Size:
+		// contents are only trusted to be the same if mtime and size are (or if Checksum compares them),
+		// otherwise an edit saved as metadata-changed would never be detected later
+		change = backup.Modified
+	default:
+		index.Keep(rel, stat)
+	}
+	if change != "" {
+		return change, nil
+	}
+	metadata, err := changedMetadata(old, dir, rel, stat)
+	if err != nil || !metadata {
 		return "", err
 	}
-	if !newStat.ModTime().After(oldStat.ModTime()) {
-		return "false", nil
+	return backup.MetadataChanged, nil
+}
+
+// changedMetadata checks whether mode, owner, mtime or extended attributes (if they are saved)
+// of dir/rel, described by stat, differ from its base backup entry
+func changedMetadata(old backup.Entry, dir string, rel string, stat os.FileInfo) (bool, error) {
+	uid, gid := file.Owner(stat)
+	if stat.Mode() != old.Mode || uid != old.Uid || gid != old.Gid || !stat.ModTime().Equal(old.ModTime) {
+		return true, nil
+	}
+	if !backup.Xattrs {
+		return false, nil
+	}
+	attrs, err := file.Xattrs(filepath.Join(dir, rel))
+	if errors.Is(err, errors.ErrUnsupported) {
+		return false, nil
 	}
-	if newStat.Size() != oldStat.Size() || entry.IsDir() {
-		return "true", nil
+	return !maps.EqualFunc(attrs, old.Xattrs, bytes.Equal), err
+}
+
+// changedContents compares dir/rel with base backup entry by contents, unless its mtime and size are the same.
+// File is only hashed if index has no hash for its current state
+func changedContents(ctx context.Context, index *backup.Index, old backup.Entry, dir string, rel string, stat os.FileInfo) (string, error) {
+	if stat.ModTime().Equal(old.ModTime) && stat.Size() == old.Size {
+		index.Keep(rel, stat)
+		return "", nil
+	}
+	path := filepath.Join(dir, rel)
+	switch {
+	case stat.Mode().IsRegular() && old.Hash != "" && stat.Size() == old.Size:
+		record, ok := index.Lookup(rel, stat)
+		hash := record.Hash
+		if !ok {
+			var err error
+			hash, err = file.Hash(ctx, path)
+			if err != nil {
+				return "", err
+			}
+		}
+		if hash == old.Hash {
+			index.Update(rel, stat, old)
+			return "", nil
+		}
+	case stat.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if link == old.Link {
+			return "", nil
+		}
 	}
-	return "false", nil
+	return backup.Modified, nil
 }
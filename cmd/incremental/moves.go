@@ -0,0 +1,75 @@
+package incremental
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/SingularGamesStudio/backup/cmd/backup"
+	"github.com/SingularGamesStudio/backup/cmd/chunk"
+)
+
+// moves finds files of base backup that were moved or renamed inside the backed up folder
+type moves struct {
+	dir    string
+	base   map[string]backup.Entry
+	byHash map[string][]string // paths of base files by contents hash
+}
+
+func newMoves(base map[string]backup.Entry, dir string) *moves {
+	m := &moves{dir: dir, base: base, byHash: make(map[string][]string)}
+	for path, entry := range base {
+		if entry.Mode.IsRegular() && entry.Hash != "" {
+			m.byHash[entry.Hash] = append(m.byHash[entry.Hash], path)
+		}
+	}
+	return m
+}
+
+// source returns base file with given contents hash, which is no longer present in dir
+func (m *moves) source(hash string) (backup.Entry, bool) {
+	for _, path := range m.byHash[hash] {
+		if m.gone(path) {
+			return m.base[path], true
+		}
+	}
+	return backup.Entry{}, false
+}
+
+// gone checks whether base file at path was deleted or replaced with something that is not a file
+func (m *moves) gone(path string) bool {
+	info, err := backup.Lstat(filepath.Join(m.dir, filepath.FromSlash(path)))
+	return errors.Is(err, os.ErrNotExist) || (err == nil && !info.Mode().IsRegular())
+}
+
+// saveAdded saves file dir/rel, which is not in base backup, to store. If it has the same contents as
+// a base file that is gone, it is recorded as moved from there. Renamed files found by index inode are not read at all
+func saveAdded(ctx context.Context, store *chunk.Store, index *backup.Index, moves *moves, dir string, rel string, info os.FileInfo) (backup.Entry, error) {
+	if info.Mode().IsRegular() {
+		if path, record, ok := index.Find(info); ok {
+			from, ok := moves.base[path]
+			if ok && from.Hash == record.Hash && moves.gone(path) {
+				entry, err := backup.NewEntry(dir, rel)
+				if err != nil {
+					return backup.Entry{}, err
+				}
+				entry.CopyContents(from)
+				entry.Change, entry.From = backup.Moved, from.Path
+				index.Update(rel, info, entry)
+				return entry, nil
+			}
+		}
+	}
+	entry, err := backup.SaveEntry(ctx, store, index, dir, rel) // chunks of moved files are already in store, so nothing new is written
+	if err != nil {
+		return backup.Entry{}, err
+	}
+	entry.Change = backup.Added
+	if entry.Mode.IsRegular() {
+		if from, ok := moves.source(entry.Hash); ok {
+			entry.Change, entry.From = backup.Moved, from.Path
+		}
+	}
+	return entry, nil
+}
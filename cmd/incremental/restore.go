@@ -3,62 +3,57 @@ package incremental
 import (
 	"context"
 	"fmt"
-	"os"
 	"path/filepath"
 
+	"github.com/SingularGamesStudio/backup/cmd/backup"
+	"github.com/SingularGamesStudio/backup/cmd/chunk"
 	"github.com/SingularGamesStudio/backup/cmd/full"
 	"github.com/SingularGamesStudio/backup/cmd/utils"
-	"github.com/SingularGamesStudio/backup/cmd/utils/file"
 )
 
-func Restore(ctx context.Context, dir string, backupDir string, fullDir string) {
-	fmt.Println("Restoring latest full backup...")
-	err := full.Restore(ctx, dir, fullDir)
+// Restore restores incremental or differential backup, applying its chain in order
+func Restore(ctx context.Context, dir string, backupDir string) {
+	chain, err := backup.Chain(backupDir)
 	if err != nil {
+		utils.PrintError("reading backup chain", err)
 		return
 	}
-	fmt.Println("Applying incremental backup...")
-	err = applyChanged(ctx, backupDir, dir)
+	fmt.Println("Restoring full backup...")
+	err = full.Restore(ctx, dir, chain[0])
 	if err != nil {
-		utils.PrintError("Applying incremental backup", err)
 		return
 	}
-	fmt.Println("Deleting backup metadata...")
-	err = os.Remove(filepath.Join(dir, utils.Metadata))
+	for _, link := range chain[1:] {
+		fmt.Printf("Applying backup %s...\n", filepath.Base(link))
+		err = applyChanged(ctx, link, dir)
+		if err != nil {
+			utils.PrintError("Applying incremental backup", err)
+			return
+		}
+	}
+	manifest, err := backup.Resolve(backupDir) // directories are changed by applying their contents
+	if err == nil {
+		err = backup.RestoreDirTimes(ctx, manifest, dir)
+	}
 	if err != nil {
-		utils.PrintError("Deleting backup metadata", err)
-		fmt.Printf("Restore successful, but file %s failed to be deleted, consider deleting it manually\n", utils.Metadata)
+		utils.PrintError("restoring directory times", err)
 		return
 	}
 	fmt.Println("Restore successful")
 }
 
-// applyChanged applies incremental backup to full
+// applyChanged applies changes recorded in incremental backup to full
 func applyChanged(ctx context.Context, src string, dest string) error {
-	entries, err := os.ReadDir(src)
+	manifest, err := backup.GetManifest(src)
 	if err != nil {
 		return err
 	}
-	for _, entry := range entries {
-		if filepath.Ext(entry.Name()) == utils.DeletedExt { // file deleted
-			err = os.RemoveAll(filepath.Join(dest, entry.Name()[:len(entry.Name())-len(utils.DeletedExt)]))
-			if err != nil {
-				return err
-			}
-			continue
-		}
-		if !entry.IsDir() { //file changed
-			err = file.CopyFile(filepath.Join(src, entry.Name()), filepath.Join(dest, entry.Name()))
-			if err != nil {
-				return err
-			}
-			continue
-		}
-		err = file.MkdirAll(filepath.Join(src, entry.Name()), filepath.Join(dest, entry.Name())) //directory changed
-		if err != nil {
-			return err
-		}
-		err = applyChanged(ctx, filepath.Join(src, entry.Name()), filepath.Join(dest, entry.Name()))
+	store, err := chunk.Open(filepath.Dir(src))
+	if err != nil {
+		return err
+	}
+	for _, entry := range manifest.Entries {
+		err = backup.ApplyEntry(ctx, store, entry, dest)
 		if err != nil {
 			return err
 		}
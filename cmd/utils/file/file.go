@@ -2,11 +2,14 @@ package file
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"time"
 )
 
 // ClearDir deletes directory contents
@@ -29,105 +32,108 @@ func ClearDir(ctx context.Context, path string) error {
 	return nil
 }
 
-// CopyFolder copies directory recursively
-func CopyFolder(ctx context.Context, src string, dest string) error {
-	entries, err := os.ReadDir(src)
+// Hash returns SHA-256 of file contents
+func Hash(ctx context.Context, path string) (string, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		return err
+		return "", err
 	}
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			err = CopyFile(filepath.Join(src, entry.Name()), filepath.Join(dest, entry.Name()))
-			if err != nil {
-				return err
-			}
-			continue
-		}
-		err = MkdirAll(filepath.Join(src, entry.Name()), filepath.Join(dest, entry.Name()))
-		if err != nil {
-			return err
+	defer file.Close()
+	hash := sha256.New()
+	buf := make([]byte, 1<<20)
+	for {
+		n, err := file.Read(buf)
+		hash.Write(buf[:n])
+		if err == io.EOF {
+			return hex.EncodeToString(hash.Sum(nil)), nil
 		}
-		err = CopyFolder(ctx, filepath.Join(src, entry.Name()), filepath.Join(dest, entry.Name()))
 		if err != nil {
-			return err
+			return "", err
 		}
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			return "", ctx.Err()
 		default:
 		}
 	}
-	return nil
 }
 
-// CopyFile copies a file or symlink
-func CopyFile(src string, dest string) error {
-	stat, err := os.Lstat(src)
-	if err != nil {
-		return err
+// Owner returns file uid and gid (zeroes on windows)
+func Owner(info os.FileInfo) (int, int) {
+	if runtime.GOOS == "windows" {
+		return 0, 0
 	}
-	if stat.Mode()&os.ModeSymlink != 0 { // copy symbolic link
-		file, err := os.Readlink(src)
+	gid := reflect.ValueOf(info.Sys()).Elem().FieldByName("Gid").Uint()
+	uid := reflect.ValueOf(info.Sys()).Elem().FieldByName("Uid").Uint()
+	return int(uid), int(gid)
+}
+
+// SetRights sets file uid, gid, and mode
+func SetRights(dest string, mode os.FileMode, uid int, gid int) error {
+	if runtime.GOOS != "windows" { //save uid/gid
+		err := os.Lchown(dest, uid, gid)
 		if err != nil {
 			return err
 		}
-		err = os.Symlink(file, dest)
+	}
+	if mode&os.ModeSymlink == 0 {
+		err := os.Chmod(dest, mode)
 		if err != nil {
 			return err
 		}
-		return CopyRights(src, dest)
 	}
+	return nil
+}
 
-	from, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer from.Close()
-	to, err := os.Create(dest)
-	if err != nil {
-		return err
+// Inode returns file inode number and status change time (zeroes on windows)
+func Inode(info os.FileInfo) (uint64, time.Time) {
+	if runtime.GOOS == "windows" {
+		return 0, time.Time{}
 	}
-	defer to.Close()
+	sys := reflect.ValueOf(info.Sys()).Elem()
+	return sys.FieldByName("Ino").Uint(), timespec(sys, "Ctim", "Ctimespec")
+}
 
-	_, err = io.Copy(to, from)
-	if err != nil {
-		return err
+// HardLinks returns device and inode identifying file, and number of its hard links (zeroes on windows)
+func HardLinks(info os.FileInfo) (uint64, uint64, uint64) {
+	if runtime.GOOS == "windows" {
+		return 0, 0, 0
 	}
-	return CopyRights(src, dest)
+	sys := reflect.ValueOf(info.Sys()).Elem()
+	return toUint(sys.FieldByName("Dev")), sys.FieldByName("Ino").Uint(), toUint(sys.FieldByName("Nlink"))
 }
 
-// MkdirAll calls os.MkdirAll(dest) with mode from src
-func MkdirAll(src string, dest string) error {
-	info, err := os.Lstat(src)
-	if err != nil {
-		return err
+// toUint converts integer field of stat, which has different types on different platforms
+func toUint(v reflect.Value) uint64 {
+	if v.CanInt() {
+		return uint64(v.Int())
 	}
-	err = os.MkdirAll(dest, info.Mode())
-	if err != nil {
-		return err
-	}
-	return CopyRights(src, dest)
+	return v.Uint()
 }
 
-// CopyRights copies file uid, gid, and mode
-func CopyRights(src string, dest string) error {
-	info, err := os.Lstat(src)
-	if err != nil {
-		return err
+// AccessTime returns file access time
+func AccessTime(info os.FileInfo) time.Time {
+	sys := reflect.ValueOf(info.Sys()).Elem()
+	if runtime.GOOS == "windows" { // syscall.Filetime
+		return time.Unix(0, sys.FieldByName("LastAccessTime").Addr().MethodByName("Nanoseconds").Call(nil)[0].Int())
 	}
-	if runtime.GOOS != "windows" { //save uid/gid
-		gid := reflect.ValueOf(info.Sys()).Elem().FieldByName("Gid").Uint()
-		uid := reflect.ValueOf(info.Sys()).Elem().FieldByName("Uid").Uint()
-		err = os.Lchown(dest, int(uid), int(gid))
-		if err != nil {
-			return err
+	return timespec(sys, "Atim", "Atimespec")
+}
+
+// timespec returns time from the first present of syscall.Timespec fields of stat (names differ between linux and darwin/bsd)
+func timespec(stat reflect.Value, names ...string) time.Time {
+	for _, name := range names {
+		if field := stat.FieldByName(name); field.IsValid() {
+			return time.Unix(field.FieldByName("Sec").Int(), field.FieldByName("Nsec").Int())
 		}
 	}
-	if info.Mode()&os.ModeSymlink == 0 {
-		err := os.Chmod(dest, info.Mode())
-		if err != nil {
-			return err
-		}
+	return time.Time{}
+}
+
+// SetTimes sets file access and modification times, of the symlink itself for symlinks
+func SetTimes(dest string, mode os.FileMode, atime time.Time, mtime time.Time) error {
+	if mode&os.ModeSymlink != 0 {
+		return lchtimes(dest, atime, mtime)
 	}
-	return nil
+	return os.Chtimes(dest, atime, mtime)
 }
@@ -0,0 +1,71 @@
+package file
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// Extent is a region of sparse file containing data, everything outside of extents is a hole
+type Extent struct {
+	Offset int64 `json:"Offset"`
+	Length int64 `json:"Length"`
+}
+
+// DataReader reads data extents of file one after another, and writes contents of the whole file
+// (zeroes in holes, up to size) to hash as they are read
+func DataReader(f *os.File, extents []Extent, size int64, hash io.Writer) io.Reader {
+	return &dataReader{file: f, extents: extents, size: size, hash: hash}
+}
+
+type dataReader struct {
+	file    *os.File
+	extents []Extent
+	size    int64
+	hash    io.Writer
+	pos     int64 // end of the last extent started
+	current io.Reader
+}
+
+func (r *dataReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.extents) == 0 {
+				if err := writeZeroes(r.hash, r.size-r.pos); err != nil {
+					return 0, err
+				}
+				r.pos = r.size
+				return 0, io.EOF
+			}
+			extent := r.extents[0]
+			r.extents = r.extents[1:]
+			if err := writeZeroes(r.hash, extent.Offset-r.pos); err != nil {
+				return 0, err
+			}
+			r.current = io.TeeReader(io.NewSectionReader(r.file, extent.Offset, extent.Length), r.hash)
+			r.pos = extent.Offset + extent.Length
+		}
+		n, err := r.current.Read(p)
+		if errors.Is(err, io.EOF) {
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+var zeroes = make([]byte, 1<<20)
+
+func writeZeroes(w io.Writer, n int64) error {
+	for n > 0 {
+		written, err := w.Write(zeroes[:min(n, int64(len(zeroes)))])
+		if err != nil {
+			return err
+		}
+		n -= int64(written)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+//go:build linux
+
+package file
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Extents returns data regions of file of given size, or nil if it has no holes. File offset is reset to its start
+func Extents(f *os.File, size int64) ([]Extent, error) {
+	defer f.Seek(0, io.SeekStart)
+	var res []Extent
+	fd := int(f.Fd())
+	for offset := int64(0); offset < size; {
+		data, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) { // only a hole is left
+			break
+		}
+		if errors.Is(err, unix.EINVAL) { // holes are not supported
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, Extent{Offset: data, Length: min(hole, size) - data})
+		offset = hole
+	}
+	if size == 0 || len(res) == 1 && res[0].Offset == 0 && res[0].Length == size {
+		return nil, nil
+	}
+	if len(res) == 0 { // file is a single hole
+		res = []Extent{{Offset: 0, Length: 0}}
+	}
+	return res, nil
+}
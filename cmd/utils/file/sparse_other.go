@@ -0,0 +1,10 @@
+//go:build !linux
+
+package file
+
+import "os"
+
+// Extents returns nil, holes are only detected on linux
+func Extents(f *os.File, size int64) ([]Extent, error) {
+	return nil, nil
+}
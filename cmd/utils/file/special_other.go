@@ -0,0 +1,18 @@
+//go:build !unix
+
+package file
+
+import (
+	"errors"
+	"os"
+)
+
+// Device returns zeroes, there are no device files on this platform
+func Device(info os.FileInfo) (uint32, uint32) {
+	return 0, 0
+}
+
+// Mknod returns errors.ErrUnsupported, special files can not be created on this platform
+func Mknod(path string, mode os.FileMode, major uint32, minor uint32) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,39 @@
+//go:build unix
+
+package file
+
+import (
+	"os"
+	"reflect"
+
+	"golang.org/x/sys/unix"
+)
+
+// Device returns major and minor numbers of device file
+func Device(info os.FileInfo) (uint32, uint32) {
+	rdev := toUint(reflect.ValueOf(info.Sys()).Elem().FieldByName("Rdev"))
+	return unix.Major(rdev), unix.Minor(rdev)
+}
+
+// Mknod creates FIFO, socket or device file (with given major and minor numbers) at path
+func Mknod(path string, mode os.FileMode, major uint32, minor uint32) error {
+	kind := uint32(unix.S_IFIFO)
+	switch {
+	case mode&os.ModeCharDevice != 0:
+		kind = unix.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		kind = unix.S_IFBLK
+	case mode&os.ModeSocket != 0:
+		kind = unix.S_IFSOCK
+	}
+	err := mknod(unix.Mknod, path, kind|uint32(mode.Perm()), unix.Mkdev(major, minor))
+	if err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
+
+// mknod calls unix.Mknod, which takes device number as int or uint64, depending on the platform
+func mknod[T int | uint64](f func(string, uint32, T) error, path string, mode uint32, dev uint64) error {
+	return f(path, mode, T(dev))
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package file
+
+import "time"
+
+// lchtimes does nothing, symlink times are not preserved on this platform
+func lchtimes(path string, atime time.Time, mtime time.Time) error {
+	return nil
+}
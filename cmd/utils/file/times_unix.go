@@ -0,0 +1,15 @@
+//go:build unix
+
+package file
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// lchtimes sets access and modification times of symlink itself, like lutimes
+func lchtimes(path string, atime time.Time, mtime time.Time) error {
+	times := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,77 @@
+//go:build linux
+
+package file
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Xattrs returns extended attributes of file (POSIX ACLs are stored among them, as system.posix_acl_*),
+// or errors.ErrUnsupported if its filesystem does not support them
+func Xattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, errors.ErrUnsupported
+	}
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		value, err := getxattr(path, name)
+		if errors.Is(err, unix.ENODATA) { // removed while listing
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+		res[name] = value
+	}
+	return res, nil
+}
+
+func getxattr(path string, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Lgetxattr(path, name, buf)
+	return buf[:size], err
+}
+
+// SetXattrs replaces extended attributes of file with attrs, or returns errors.ErrUnsupported if its filesystem does not support them.
+// Only user attributes and ACLs are removed, labels set by the system (like security.selinux) are kept
+func SetXattrs(path string, attrs map[string][]byte) error {
+	old, err := Xattrs(path)
+	if err != nil {
+		return err
+	}
+	for name := range old {
+		if _, ok := attrs[name]; !ok && (strings.HasPrefix(name, "user.") || strings.HasPrefix(name, "system.posix_acl_")) {
+			err = unix.Lremovexattr(path, name)
+			if err != nil {
+				return fmt.Errorf("removing %s: %w", name, err)
+			}
+		}
+	}
+	for name, value := range attrs {
+		err = unix.Lsetxattr(path, name, value, 0)
+		if errors.Is(err, unix.ENOTSUP) {
+			return errors.ErrUnsupported
+		}
+		if err != nil {
+			return fmt.Errorf("setting %s: %w", name, err)
+		}
+	}
+	return nil
+}
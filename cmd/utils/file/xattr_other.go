@@ -0,0 +1,15 @@
+//go:build !linux
+
+package file
+
+import "errors"
+
+// Xattrs returns errors.ErrUnsupported, extended attributes are only supported on linux
+func Xattrs(path string) (map[string][]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// SetXattrs returns errors.ErrUnsupported, extended attributes are only supported on linux
+func SetXattrs(path string, attrs map[string][]byte) error {
+	return errors.ErrUnsupported
+}
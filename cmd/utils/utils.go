@@ -4,19 +4,28 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strings"
 	"syscall"
+
+	"golang.org/x/term"
 )
 
 const (
-	Metadata   = ".backup.json"
-	DeletedExt = ".deleted"
+	Metadata = ".backup.json"
+	Manifest = "manifest.json"
+	Chunks   = "chunks"
+	Config   = "config.json"
+	Keys     = "keys"
+	Index    = "index"
 )
 
 var ErrAborted = errors.New("Backup aborted by user")
 
+var ErrCorrupted = errors.New("Backup data is corrupted or was tampered with")
+
 // Yes returns true for any prompts
 var Yes = false
 
@@ -43,12 +52,29 @@ func AskForConfirmation(s string) bool {
 	}
 }
 
+// AskPassword asks user for a password, without echoing it if stdin is a terminal
+func AskPassword(s string) (string, error) {
+	fmt.Printf("%s: ", s)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		password, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		return string(password), err
+	}
+	response, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && (err != io.EOF || response == "") {
+		return "", err
+	}
+	return strings.TrimRight(response, "\r\n"), nil
+}
+
 // PrintError prints user-friendly error message caught in given context
 func PrintError(context string, err error) {
 	if errors.Is(err, os.ErrPermission) {
 		fmt.Println(fmt.Errorf("Permission denied in {%s}: %w", context, err))
 	} else if errors.Is(err, ErrAborted) {
 		fmt.Println(fmt.Errorf("Aborted by user in {%s}", context))
+	} else if errors.Is(err, ErrCorrupted) {
+		fmt.Println(fmt.Errorf("Refusing to continue {%s}: %w", context, err))
 	} else if errors.Is(err, syscall.ENOSPC) {
 		fmt.Println(fmt.Errorf("Not enough space to perform {%s}", context))
 	} else {
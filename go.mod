@@ -1,3 +1,10 @@
 module github.com/SingularGamesStudio/backup
 
 go 1.22.0
+
+require (
+	github.com/klauspost/compress v1.17.11
+	golang.org/x/crypto v0.31.0
+	golang.org/x/sys v0.28.0
+	golang.org/x/term v0.27.0
+)
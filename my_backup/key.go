@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/SingularGamesStudio/backup/cmd/crypt"
+	"github.com/SingularGamesStudio/backup/cmd/utils"
+)
+
+// key manages keys of an encrypted backup folder
+func key(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: my_backup key add|remove|list|passwd [flags] <backup_folder> [key id]")
+		os.Exit(2)
+	}
+	action := args[0]
+	flags := flag.NewFlagSet("my_backup key "+action, flag.ExitOnError)
+	flags.StringVar(&crypt.KeyFile, "key-file", "", "use contents of `file` instead of current passphrase")
+	flags.StringVar(&crypt.NewKeyFile, "new-key-file", "", "use contents of `file` instead of new passphrase (taken from "+crypt.NewPassphraseEnv+" if set)")
+	flags.StringVar(&crypt.KeyName, "name", crypt.KeyName, "`name` of the new key")
+	_ = flags.Parse(args[1:])
+	expected := 1
+	if action == "remove" {
+		expected = 2
+	}
+	if flags.NArg() != expected {
+		fmt.Printf("Usage: my_backup key %s [flags] <backup_folder>", action)
+		if action == "remove" {
+			fmt.Print(" <key id>")
+		}
+		fmt.Println()
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	root := flags.Arg(0)
+	switch action {
+	case "add":
+		slot, err := crypt.AddKey(root, crypt.KeyName)
+		if err != nil {
+			utils.PrintError("adding key", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Key %s added\n", slot.ID)
+	case "remove":
+		err := crypt.RemoveKey(root, flags.Arg(1))
+		if err != nil {
+			utils.PrintError("removing key", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Key %s removed\n", flags.Arg(1))
+	case "list":
+		slots, err := crypt.Slots(root)
+		if err != nil {
+			utils.PrintError("listing keys", err)
+			os.Exit(1)
+		}
+		for _, slot := range slots {
+			fmt.Printf("%s\t%s\t%s\n", slot.ID, slot.Created.Format("2006-01-02 15:04:05"), slot.Name)
+		}
+	case "passwd":
+		err := crypt.ChangePassphrase(root)
+		if err != nil {
+			utils.PrintError("changing passphrase", err)
+			os.Exit(1)
+		}
+		fmt.Println("Passphrase changed")
+	default:
+		fmt.Printf("Error: unknown key command: %s, supported commands are add, remove, list and passwd\n", action)
+		os.Exit(2)
+	}
+}
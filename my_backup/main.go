@@ -2,19 +2,100 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/SingularGamesStudio/backup/cmd/backup"
+	"github.com/SingularGamesStudio/backup/cmd/chunk"
+	"github.com/SingularGamesStudio/backup/cmd/crypt"
 	"github.com/SingularGamesStudio/backup/cmd/full"
+	"github.com/SingularGamesStudio/backup/cmd/ignore"
 	"github.com/SingularGamesStudio/backup/cmd/incremental"
 )
 
+// codecFlag is a flag, that can be used both as --compress and --compress=<codec>
+type codecFlag struct {
+	codec *string
+}
+
+func (f codecFlag) String() string {
+	if f.codec == nil {
+		return ""
+	}
+	return *f.codec
+}
+
+func (f codecFlag) Set(s string) error {
+	switch s {
+	case "true":
+		s = "gzip"
+	case "false":
+		s = ""
+	}
+	err := chunk.ValidCodec(s)
+	if err != nil {
+		return err
+	}
+	*f.codec = s
+	return nil
+}
+
+func (f codecFlag) IsBoolFlag() bool {
+	return true
+}
+
 func main() {
+	if len(os.Args) < 2 {
+		fmt.Println("Usage: my_backup <type> [flags] <folder> <backup_folder>")
+		fmt.Println("       my_backup consolidate [flags] <backup_folder>")
+		fmt.Println("       my_backup key add|remove|list|passwd [flags] <backup_folder> [key id]")
+		os.Exit(2)
+	}
 	backupType := os.Args[1]
-	dir := os.Args[2]
-	backupDir := os.Args[3]
+	if backupType == "key" {
+		key(os.Args[2:])
+		return
+	}
+	flags := flag.NewFlagSet("my_backup "+backupType, flag.ExitOnError)
+	flags.Var(codecFlag{&chunk.Compression}, "compress", "compress file contents with `codec` (gzip or zstd, gzip if omitted)")
+	flags.BoolVar(&crypt.Encrypt, "encrypt", false, "encrypt new backup folder (passphrase is asked or taken from "+crypt.PassphraseEnv+")")
+	flags.StringVar(&crypt.KeyFile, "key-file", "", "use contents of `file` instead of passphrase")
+	flags.BoolVar(&incremental.Checksum, "checksum", false, "detect changed files by content hash, not only by mtime and size")
+	flags.BoolVar(&incremental.Delta, "delta", false, "save modified files as binary deltas against their previous versions")
+	flags.BoolVar(&backup.Xattrs, "xattrs", false, "save extended attributes and POSIX ACLs")
+	flags.Func("symlinks", "`policy` for symbolic links: preserve (save links, default), follow (save what they point to) or skip", func(s string) error {
+		backup.Symlinks = s
+		return backup.ValidSymlinks(s)
+	})
+	flags.BoolVar(&backup.OneFileSystem, "one-file-system", false, "do not save contents of other filesystems mounted inside the folder")
+	flags.Func("exclude", "do not save paths matching gitignore-style `pattern` (can be repeated)", func(s string) error {
+		backup.Exclude = append(backup.Exclude, s)
+		return ignore.Valid(s)
+	})
+	flags.Func("include", "save paths matching gitignore-style `pattern`, even if they are excluded (can be repeated)", func(s string) error {
+		backup.Exclude = append(backup.Exclude, "!"+s)
+		return ignore.Valid(s)
+	})
+	flags.BoolVar(&backup.GitIgnore, "gitignore", false, "do not save paths ignored by .gitignore files")
+	flags.BoolVar(&backup.ExcludeCaches, "exclude-caches", false, "do not save directories tagged with "+ignore.CacheTag)
+	_ = flags.Parse(os.Args[2:])
+	var dir, backupDir string
+	if backupType == "consolidate" && flags.NArg() == 1 {
+		dir, backupDir = "", flags.Arg(0)
+	} else if flags.NArg() == 2 {
+		dir, backupDir = flags.Arg(0), flags.Arg(1)
+	} else {
+		if backupType == "consolidate" {
+			fmt.Println("Usage: my_backup consolidate [flags] <backup_folder>")
+		} else {
+			fmt.Printf("Usage: my_backup %s [flags] <folder> <backup_folder>\n", backupType)
+		}
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	done := make(chan bool, 1)
@@ -24,8 +105,12 @@ func main() {
 			full.Backup(ctx, dir, backupDir)
 		case "incremental":
 			incremental.Backup(ctx, dir, backupDir)
+		case "differential":
+			incremental.Differential(ctx, dir, backupDir)
+		case "consolidate":
+			incremental.Consolidate(ctx, backupDir)
 		default:
-			fmt.Printf("Error: unknown backup type: %s, supported types are incremental and full", backupType)
+			fmt.Printf("Error: unknown backup type: %s, supported types are full, incremental and differential", backupType)
 		}
 		done <- true
 	}()
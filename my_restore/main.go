@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
@@ -9,17 +10,30 @@ import (
 	"syscall"
 
 	"github.com/SingularGamesStudio/backup/cmd/backup"
+	"github.com/SingularGamesStudio/backup/cmd/crypt"
 	"github.com/SingularGamesStudio/backup/cmd/full"
 	"github.com/SingularGamesStudio/backup/cmd/incremental"
 	"github.com/SingularGamesStudio/backup/cmd/utils"
 )
 
 func main() {
-	backupDir := os.Args[1]
-	dir := os.Args[2]
+	flags := flag.NewFlagSet("my_restore", flag.ExitOnError)
+	flags.StringVar(&crypt.KeyFile, "key-file", "", "use contents of `file` instead of passphrase")
+	noTimes := flags.Bool("no-times", false, "do not restore modification and access times")
+	flags.BoolVar(&backup.UnsafeLinks, "unsafe-links", false, "restore symbolic links pointing outside of the restored folder (absolute ones, or with too many ..)")
+	_ = flags.Parse(os.Args[1:])
+	if flags.NArg() != 2 {
+		fmt.Println("Usage: my_restore [flags] <backup_folder/datetime> <folder>")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	backup.Times = !*noTimes
+	backupDir := flags.Arg(0)
+	dir := flags.Arg(1)
 	info, err := backup.GetJson(backupDir)
 	if err != nil {
-		print("Failed to read %s: %s", filepath.Join(backupDir, utils.Metadata), err.Error())
+		utils.PrintError(fmt.Sprintf("reading %s", filepath.Join(backupDir, utils.Metadata)), err)
+		os.Exit(1)
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -28,10 +42,10 @@ func main() {
 		switch info.Type {
 		case "full":
 			_ = full.Restore(ctx, dir, backupDir)
-		case "incremental":
-			incremental.Restore(ctx, dir, backupDir, filepath.Join(filepath.Dir(backupDir), info.Base))
+		case "incremental", "differential":
+			incremental.Restore(ctx, dir, backupDir)
 		default:
-			fmt.Printf("Error: unknown backup type in %s: %s, supported types are incremental and full", filepath.Join(backupDir, utils.Metadata), info.Type)
+			fmt.Printf("Error: unknown backup type in %s: %s, supported types are full, incremental and differential", filepath.Join(backupDir, utils.Metadata), info.Type)
 		}
 		done <- true
 	}()